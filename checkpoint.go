@@ -0,0 +1,194 @@
+package blackbox
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const CHECKPOINT_INTERVAL = 1 * time.Second
+
+const checkpointFilename = "checkpoints.json"
+
+type checkpoint struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	// Head is how the file starts, to recognize it once it was rotated and
+	// compressed.
+	Head []byte `json:"head,omitempty"`
+}
+
+// CheckpointStore records how far each tailed file has been read, so that a
+// restarted blackbox can resume where it left off instead of seeking to the
+// end of every file.
+type CheckpointStore struct {
+	path           string
+	catchUpRotated bool
+
+	lock        sync.Mutex
+	checkpoints map[string]checkpoint
+	// changes counts the changes to the checkpoints, and flushed how many of
+	// them have been written to disk.
+	changes uint64
+	flushed uint64
+}
+
+// NewCheckpointStore loads the checkpoints in stateDir. With catchUpRotated,
+// files that were rotated while blackbox was down are read from where they
+// were left off before the new files at their paths.
+func NewCheckpointStore(stateDir string, catchUpRotated bool) (*CheckpointStore, error) {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return nil, err
+	}
+
+	store := &CheckpointStore{
+		path:           filepath.Join(stateDir, checkpointFilename),
+		catchUpRotated: catchUpRotated,
+		checkpoints:    map[string]checkpoint{},
+	}
+
+	contents, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &store.checkpoints); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Resume returns the offset to continue reading path from. It only succeeds
+// for a checkpointed path. A file that was replaced, truncated, or no longer
+// starts as it did was written to after the checkpoint, and is resumed from
+// the beginning.
+func (s *CheckpointStore) Resume(path string) (int64, bool) {
+	s.lock.Lock()
+	saved, found := s.checkpoints[path]
+	s.lock.Unlock()
+	if !found {
+		return 0, false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	inode, err := fileID(path)
+	if err != nil {
+		return 0, false
+	}
+
+	if inode != saved.Inode || info.Size() < saved.Offset || !startsWith(path, saved.Head) {
+		return 0, true
+	}
+
+	return saved.Offset, true
+}
+
+// Rotated returns the rest of the file checkpointed for path if it was
+// rotated since, so that the lines written to it after the checkpoint are not
+// lost. It returns nil unless catching up on rotated files is enabled.
+func (s *CheckpointStore) Rotated(path string) *rotatedFile {
+	if !s.catchUpRotated {
+		return nil
+	}
+
+	s.lock.Lock()
+	saved, found := s.checkpoints[path]
+	s.lock.Unlock()
+	if !found {
+		return nil
+	}
+
+	inode, err := fileID(path)
+	if err != nil || (inode == saved.Inode && startsWith(path, saved.Head)) {
+		return nil
+	}
+
+	return findRotated(path, saved)
+}
+
+// Record checkpoints that path, whose contents start with head, has been
+// read up to offset.
+func (s *CheckpointStore) Record(path string, inode uint64, offset int64, head []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.checkpoints[path] = checkpoint{Inode: inode, Offset: offset, Head: head}
+	s.changes++
+}
+
+// Prune forgets the checkpoints of files that no longer exist.
+func (s *CheckpointStore) Prune() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for path := range s.checkpoints {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			delete(s.checkpoints, path)
+			s.changes++
+		}
+	}
+}
+
+// Flush atomically writes the checkpoints to disk if they changed since the
+// last successful flush.
+func (s *CheckpointStore) Flush() error {
+	s.lock.Lock()
+	if s.changes == s.flushed {
+		s.lock.Unlock()
+		return nil
+	}
+	contents, err := json.Marshal(s.checkpoints)
+	changes := s.changes
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), checkpointFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), s.path); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.flushed = max(s.flushed, changes)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *CheckpointStore) FlushEvery(interval time.Duration, logger *log.Logger) {
+	for {
+		time.Sleep(interval)
+
+		if err := s.Flush(); err != nil {
+			logger.Printf("could not write checkpoints: %s\n", err)
+		}
+	}
+}
@@ -4,16 +4,18 @@ import (
 	"flag"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"sort"
+	"syscall"
 	"time"
 
-	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/sigmon"
 
 	"code.cloudfoundry.org/blackbox"
+	"code.cloudfoundry.org/blackbox/metrics"
 )
 
 var configPath = flag.String(
@@ -31,6 +33,10 @@ func (writer LogWriter) Write(bytes []byte) (int, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	logger := log.New(os.Stderr, "", log.LstdFlags)
@@ -53,30 +59,63 @@ func main() {
 	}
 
 	group := grouper.NewDynamic(nil, 0, 0)
-	running := ifrit.Invoke(sigmon.New(group))
-
-	var structuredData rfc5424.StructuredData
-	if config.StructuredDataID != "" {
-		params := []rfc5424.SDParam{}
-		keys := []string{}
-		for key := range config.StructuredDataMap {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-		for _, key := range keys {
-			params = append(params, rfc5424.SDParam{Name: key, Value: config.StructuredDataMap[key]})
+
+	var checkpoints *blackbox.CheckpointStore
+	if config.StateDir != "" {
+		checkpoints, err = blackbox.NewCheckpointStore(config.StateDir, config.CatchUpRotated)
+		if err != nil {
+			logger.Fatalf("could not load checkpoints: %s\n", err)
 		}
-		structuredData = rfc5424.StructuredData{
-			ID:         config.StructuredDataID,
-			Parameters: params,
+		go checkpoints.FlushEvery(blackbox.CHECKPOINT_INTERVAL, logger)
+	}
+
+	priorities, err := blackbox.NewPriorityResolver(config.Syslog)
+	if err != nil {
+		logger.Fatalf("invalid syslog priority configuration: %s\n", err)
+	}
+
+	multiline, err := blackbox.NewMultilineRules(config.Syslog.Multiline)
+	if err != nil {
+		logger.Fatalf("invalid multiline configuration: %s\n", err)
+	}
+
+	destinations, err := blackbox.NewDestinations(logger, config)
+	if err != nil {
+		logger.Fatalf("could not drain to syslog: %s\n", err)
+	}
+	swappable := blackbox.NewSwappableDestinations(logger, destinations)
+
+	fileWatchers := blackbox.NewFileWatchers(logger, group.Client(), swappable, checkpoints)
+
+	if config.MetricsAddress != "" {
+		listener, err := net.Listen("tcp", config.MetricsAddress)
+		if err != nil {
+			logger.Fatalf("could not listen for metrics: %s\n", err)
 		}
+		health := blackbox.NewHealthHandler(fileWatchers.Scanned(), config.HealthCheckWindow)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		mux.HandleFunc("/healthz", health.Healthz)
+		mux.HandleFunc("/readyz", health.Readyz)
+		go func() {
+			logger.Fatalf("metrics server failed: %s\n", http.Serve(listener, mux)) //nolint:gosec
+		}()
 	}
-	go func() {
-		fileWatcher := blackbox.NewFileWatcher(logger, config.Syslog.SourceDir, config.Syslog.LogFilename, group.Client(), config.Syslog.Destination, config.Hostname, config.MaxMessageSize, structuredData, config.Syslog.ExcludeFilePattern)
-		fileWatcher.Watch()
-	}()
+
+	reloader := blackbox.NewReloader(logger, *configPath, config, swappable, fileWatchers)
+	running := ifrit.Invoke(sigmon.New(blackbox.NewReloadRunner(group, reloader.Reload), syscall.SIGHUP))
+
+	fileWatchers.Apply(config.SourceConfigs(), priorities, multiline)
 
 	err = <-running.Wait()
+	if closeErr := swappable.Close(); closeErr != nil {
+		logger.Printf("could not send all messages: %s\n", closeErr)
+	}
+	if checkpoints != nil {
+		if flushErr := checkpoints.Flush(); flushErr != nil {
+			logger.Printf("could not write checkpoints: %s\n", flushErr)
+		}
+	}
 	if err != nil {
 		logger.Fatalf("failed: %s", err)
 	}
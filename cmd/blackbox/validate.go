@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"code.cloudfoundry.org/blackbox"
+)
+
+// validate checks a configuration file without running blackbox and reports
+// every problem found, for deploy pipelines to reject broken configuration
+// before rolling it out. It returns the exit code.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the configuration file to validate")
+	flags.Parse(args) //nolint:errcheck
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "-config must be specified")
+		return 2
+	}
+
+	if _, err := blackbox.LoadConfig(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", *configPath)
+		for _, problem := range problems(err) {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", *configPath)
+	return 0
+}
+
+// problems lists the errors joined in err one by one.
+func problems(err error) []string {
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		return typeErr.Errors
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var list []string
+		for _, err := range joined.Unwrap() {
+			list = append(list, problems(err)...)
+		}
+		return list
+	}
+	return []string{err.Error()}
+}
@@ -1,18 +1,40 @@
 package blackbox
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
 
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
 	"gopkg.in/yaml.v3"
 
 	"code.cloudfoundry.org/blackbox/syslog"
 )
 
 type SyslogConfig struct {
-	Destination        syslog.Drain `yaml:"destination"`
-	SourceDir          string       `yaml:"source_dir"`
-	ExcludeFilePattern string       `yaml:"exclude_file_pattern"`
-	LogFilename        bool         `yaml:"log_filename"`
+	Destination         syslog.Drain       `yaml:"destination"`
+	Destinations        []DestinationGroup `yaml:"destinations"`
+	SourceDir           string             `yaml:"source_dir"`
+	ExcludeFilePattern  string             `yaml:"exclude_file_pattern"`
+	IncludeFilePatterns []string           `yaml:"include_file_patterns"`
+	ExcludeFilePatterns []string           `yaml:"exclude_file_patterns"`
+	LogFilename         bool               `yaml:"log_filename"`
+	Discovery           string             `yaml:"discovery"`
+	IdleTimeout         time.Duration      `yaml:"idle_timeout"`
+	StartPosition       string             `yaml:"start_position"`
+	Sources             []SourceConfig     `yaml:"sources"`
+	Facility            string             `yaml:"facility"`
+	Severity            string             `yaml:"severity"`
+	PriorityOverrides   []PriorityOverride `yaml:"priority_overrides"`
+	SeverityRules       []SeverityRule     `yaml:"severity_rules"`
+	Multiline           []MultilineConfig  `yaml:"multiline"`
 }
 
 type Config struct {
@@ -22,6 +44,10 @@ type Config struct {
 	Syslog            SyslogConfig      `yaml:"syslog"`
 	UseRFC3339        bool              `yaml:"use_rfc3339"`
 	MaxMessageSize    int               `yaml:"max_message_size"`
+	StateDir          string            `yaml:"state_dir"`
+	CatchUpRotated    bool              `yaml:"catch_up_rotated"`
+	MetricsAddress    string            `yaml:"metrics_address"`
+	HealthCheckWindow time.Duration     `yaml:"health_check_window"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -32,8 +58,14 @@ func LoadConfig(path string) (*Config, error) {
 
 	var config Config
 
-	if err := yaml.Unmarshal(configFile, &config); err != nil {
-		return nil, err
+	decoder := yaml.NewDecoder(bytes.NewReader(configFile))
+	decoder.KnownFields(true)
+	decodeErr := decoder.Decode(&config)
+	var typeErr *yaml.TypeError
+	if decodeErr == io.EOF {
+		decodeErr = nil
+	} else if decodeErr != nil && !errors.As(decodeErr, &typeErr) {
+		return nil, decodeErr
 	}
 
 	if config.Hostname == "" {
@@ -47,9 +79,171 @@ func LoadConfig(path string) (*Config, error) {
 	if config.MaxMessageSize == 0 {
 		config.MaxMessageSize = 99990
 	}
-	if config.Syslog.Destination.Transport == "udp" {
-		config.MaxMessageSize = 1024
+
+	// unknown fields and values of the wrong type leave the rest decoded, so
+	// it is validated as well to report all problems at once
+	if err := errors.Join(decodeErr, config.Validate()); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
 }
+
+// Validate returns every problem with the configuration that can be found
+// without starting to tail files, joined into one error.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(field string, err error) {
+		errs = append(errs, syslog.FieldErrors(field, err)...)
+	}
+
+	if len(c.Syslog.Sources) == 0 {
+		if c.Syslog.SourceDir == "" {
+			check("syslog.source_dir", errors.New("must be set"))
+		} else {
+			check("syslog.source_dir", checkSourceDir(c.Syslog.SourceDir))
+		}
+		if _, err := filepath.Match(c.Syslog.ExcludeFilePattern, ""); err != nil {
+			check("syslog.exclude_file_pattern", err)
+		}
+		check("syslog", validateFilePatterns(c.Syslog.IncludeFilePatterns, c.Syslog.ExcludeFilePatterns))
+	} else {
+		if c.Syslog.SourceDir != "" {
+			check("syslog.source_dir", errors.New("must not be set together with syslog.sources"))
+		}
+		if c.Syslog.ExcludeFilePattern != "" {
+			check("syslog.exclude_file_pattern", errors.New("must not be set together with syslog.sources"))
+		}
+		if len(c.Syslog.IncludeFilePatterns) > 0 {
+			check("syslog.include_file_patterns", errors.New("must not be set together with syslog.sources"))
+		}
+		if len(c.Syslog.ExcludeFilePatterns) > 0 {
+			check("syslog.exclude_file_patterns", errors.New("must not be set together with syslog.sources"))
+		}
+		if c.Syslog.LogFilename {
+			check("syslog.log_filename", errors.New("must not be set together with syslog.sources"))
+		}
+	}
+
+	groupNames := map[string]bool{}
+	if len(c.Syslog.Destinations) == 0 {
+		check("syslog.destination", c.Syslog.Destination.Validate())
+	} else if c.Syslog.Destination.Transport != "" {
+		check("syslog.destination", errors.New("must not be set together with syslog.destinations"))
+	}
+	for i, group := range c.Syslog.Destinations {
+		field := fmt.Sprintf("syslog.destinations[%d]", i)
+		if group.Name != "" {
+			if groupNames[group.Name] {
+				check(field+".name", fmt.Errorf("%q is used by another destination group", group.Name))
+			}
+			groupNames[group.Name] = true
+		}
+		check(field, group.validate())
+	}
+
+	check("syslog.discovery", validateDiscovery(c.Syslog.Discovery))
+	if c.Syslog.IdleTimeout < 0 {
+		check("syslog.idle_timeout", errors.New("must not be negative"))
+	}
+	check("syslog.start_position", validateStartPosition(c.Syslog.StartPosition))
+
+	sourceNames := map[string]bool{}
+	for i, source := range c.Syslog.Sources {
+		field := fmt.Sprintf("syslog.sources[%d]", i)
+		check(field, source.validate(groupNames))
+		if name := source.name(); name != "" {
+			if sourceNames[name] {
+				check(field+".name", fmt.Errorf("%q is used by another source", name))
+			}
+			sourceNames[name] = true
+		}
+	}
+
+	if _, err := NewPriorityResolver(c.Syslog); err != nil {
+		check("syslog", err)
+	}
+	if _, err := NewMultilineRules(c.Syslog.Multiline); err != nil {
+		check("syslog.multiline", err)
+	}
+
+	if c.CatchUpRotated && c.StateDir == "" {
+		check("catch_up_rotated", errors.New("needs a state_dir"))
+	}
+	if c.MaxMessageSize < 0 {
+		check("max_message_size", errors.New("must not be negative"))
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			check("metrics_address", err)
+		}
+	}
+	if c.HealthCheckWindow < 0 {
+		check("health_check_window", errors.New("must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// StructuredData returns the structured data added to every message, with
+// its parameters sorted by name.
+func (c *Config) StructuredData() rfc5424.StructuredData {
+	return structuredData(c.StructuredDataID, c.StructuredDataMap)
+}
+
+// SourceConfigs returns the sources to tail files from. Without a sources
+// list, there is a single source for source_dir, which excludes the files
+// whose name matches exclude_file_pattern in any directory. Sources without a
+// discovery mode, idle timeout or start position use the ones under syslog.
+func (c *Config) SourceConfigs() []SourceConfig {
+	if len(c.Syslog.Sources) == 0 {
+		excludeFilePatterns := slices.Clone(c.Syslog.ExcludeFilePatterns)
+		if c.Syslog.ExcludeFilePattern != "" {
+			excludeFilePatterns = append(excludeFilePatterns, "**/"+c.Syslog.ExcludeFilePattern)
+		}
+		return []SourceConfig{{
+			Dir:                 c.Syslog.SourceDir,
+			IncludeFilePatterns: c.Syslog.IncludeFilePatterns,
+			ExcludeFilePatterns: excludeFilePatterns,
+			LogFilename:         c.Syslog.LogFilename,
+			Discovery:           c.Syslog.Discovery,
+			IdleTimeout:         c.Syslog.IdleTimeout,
+			StartPosition:       c.Syslog.StartPosition,
+		}}
+	}
+
+	sources := slices.Clone(c.Syslog.Sources)
+	for i := range sources {
+		if sources[i].Discovery == "" {
+			sources[i].Discovery = c.Syslog.Discovery
+		}
+		if sources[i].IdleTimeout == 0 {
+			sources[i].IdleTimeout = c.Syslog.IdleTimeout
+		}
+		if sources[i].StartPosition == "" {
+			sources[i].StartPosition = c.Syslog.StartPosition
+		}
+	}
+	return sources
+}
+
+func structuredData(id string, paramsMap map[string]string) rfc5424.StructuredData {
+	if id == "" {
+		return rfc5424.StructuredData{}
+	}
+
+	keys := []string{}
+	for key := range paramsMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := []rfc5424.SDParam{}
+	for _, key := range keys {
+		params = append(params, rfc5424.SDParam{Name: key, Value: paramsMap[key]})
+	}
+	return rfc5424.StructuredData{
+		ID:         id,
+		Parameters: params,
+	}
+}
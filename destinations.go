@@ -0,0 +1,317 @@
+package blackbox
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+
+	"code.cloudfoundry.org/blackbox/syslog"
+)
+
+const defaultPrimaryCheckInterval = 30 * time.Second
+
+type DestinationGroup struct {
+	Name                 string         `yaml:"name"`
+	Mode                 string         `yaml:"mode"`
+	Destinations         []syslog.Drain `yaml:"destinations"`
+	PrimaryCheckInterval time.Duration  `yaml:"primary_check_interval"`
+}
+
+// validate checks the settings of the group and of its destinations.
+func (g DestinationGroup) validate() error {
+	var errs []error
+	check := func(field string, err error) {
+		errs = append(errs, syslog.FieldErrors(field, err)...)
+	}
+
+	switch g.Mode {
+	case "", syslog.ModeFanOut:
+	case syslog.ModeFailover:
+		// whether a local sink is reachable again cannot be checked
+		if len(g.Destinations) > 0 && syslog.IsLocalTransport(g.Destinations[0].Transport) {
+			check("destinations[0].transport", fmt.Errorf("%s cannot be the primary of a failover group", g.Destinations[0].Transport))
+		}
+	default:
+		check("mode", fmt.Errorf("unknown destination group mode %q", g.Mode))
+	}
+	if len(g.Destinations) == 0 {
+		check("destinations", errors.New("must not be empty"))
+	}
+	if g.PrimaryCheckInterval < 0 {
+		check("primary_check_interval", errors.New("must not be negative"))
+	}
+	for i, drain := range g.Destinations {
+		check(fmt.Sprintf("destinations[%d]", i), drain.Validate())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Destinations are the drainers of the destination groups, which all sources
+// share, and which of them the messages of each source are sent to.
+type Destinations struct {
+	names   []string
+	groups  []syslog.Drainer
+	all     syslog.Drainer
+	sources map[string]sourceDestination
+}
+
+type sourceDestination struct {
+	drainer        syslog.Drainer
+	structuredData rfc5424.StructuredData
+}
+
+// NewDestinations builds the drainers of the configured destination groups.
+// Sources that do not refer to a group by name send every message to each of
+// them.
+func NewDestinations(logger *log.Logger, config *Config) (*Destinations, error) {
+	groups := config.Syslog.Destinations
+	if len(groups) == 0 {
+		groups = []DestinationGroup{{
+			Mode:         syslog.ModeFanOut,
+			Destinations: []syslog.Drain{config.Syslog.Destination},
+		}}
+	}
+
+	d := &Destinations{sources: map[string]sourceDestination{}}
+	named := map[string]syslog.Drainer{}
+	for _, group := range groups {
+		drainer, err := newGroupDrainer(logger, group, config.Hostname, config.StructuredData(), config.MaxMessageSize)
+		if err != nil {
+			// release spools and files, which rebuilding may need again
+			d.Close() //nolint:errcheck
+			return nil, err
+		}
+		d.names = append(d.names, group.Name)
+		d.groups = append(d.groups, drainer)
+		if group.Name != "" {
+			named[group.Name] = drainer
+		}
+	}
+
+	d.all = d.groups[0]
+	if len(d.groups) > 1 {
+		d.all = syslog.NewFanOut(d.groups...)
+	}
+
+	for _, source := range config.SourceConfigs() {
+		drainer := d.all
+		if source.Destination != "" {
+			var found bool
+			drainer, found = named[source.Destination]
+			if !found {
+				d.Close() //nolint:errcheck
+				return nil, fmt.Errorf("source %s refers to unknown destination group %q", source.name(), source.Destination)
+			}
+		}
+		d.sources[source.name()] = sourceDestination{
+			drainer:        drainer,
+			structuredData: source.StructuredData(),
+		}
+	}
+
+	return d, nil
+}
+
+// Drain sends a message read by the named source to its destinations.
+func (d *Destinations) Drain(source string, message syslog.Message) error {
+	destination, found := d.sources[source]
+	if !found {
+		// the source was removed by a reload and its files are being stopped
+		return d.all.Drain(message)
+	}
+
+	if message.StructuredData.ID == "" {
+		message.StructuredData = destination.structuredData
+	}
+	return destination.drainer.Drain(message)
+}
+
+func (d *Destinations) Flush() error {
+	var errs []error
+	for _, group := range d.groups {
+		errs = append(errs, syslog.Flush(group))
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Destinations) Close() error {
+	return errors.Join(d.close()...)
+}
+
+// close closes the drainer of every group, returning the error of each.
+func (d *Destinations) close() []error {
+	errs := make([]error, len(d.groups))
+	for i, group := range d.groups {
+		errs[i] = syslog.Close(group)
+	}
+	return errs
+}
+
+// group returns the drainer of the group with the given name, or at the given
+// position if it has none, falling back to all groups.
+func (d *Destinations) group(name string, index int) syslog.Drainer {
+	for i, groupName := range d.names {
+		if name != "" && groupName == name {
+			return d.groups[i]
+		}
+	}
+	if name == "" && index < len(d.groups) && d.names[index] == "" {
+		return d.groups[index]
+	}
+	return d.all
+}
+
+func newGroupDrainer(logger *log.Logger, group DestinationGroup, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int) (syslog.Drainer, error) {
+	if len(group.Destinations) == 0 {
+		return nil, errors.New("destination group has no destinations")
+	}
+
+	switch group.Mode {
+	case "", syslog.ModeFanOut:
+		var drainers []syslog.Drainer
+		for _, drain := range group.Destinations {
+			destination, err := syslog.NewDestination(logger, drain, hostname, structuredData, maxMessageSize)
+			if err != nil {
+				return nil, err
+			}
+			drainer, err := withSpool(logger, drain.Spool, destination)
+			if err != nil {
+				return nil, err
+			}
+			drainers = append(drainers, drainer)
+		}
+
+		if len(drainers) == 1 {
+			return drainers[0], nil
+		}
+		return syslog.NewFanOut(drainers...), nil
+	case syslog.ModeFailover:
+		primaryCheckInterval := group.PrimaryCheckInterval
+		if primaryCheckInterval == 0 {
+			primaryCheckInterval = defaultPrimaryCheckInterval
+		}
+
+		failover, err := syslog.NewFailover(logger, group.Destinations, hostname, structuredData, maxMessageSize, primaryCheckInterval)
+		if err != nil {
+			return nil, err
+		}
+		// the spool of the primary buffers for the whole group
+		return withSpool(logger, group.Destinations[0].Spool, failover)
+	default:
+		return nil, fmt.Errorf("unknown destination group mode: %q", group.Mode)
+	}
+}
+
+func withSpool(logger *log.Logger, config syslog.SpoolConfig, drainer syslog.Drainer) (syslog.Drainer, error) {
+	if config.Dir == "" {
+		return drainer, nil
+	}
+
+	spool, err := syslog.NewSpool(logger, config, drainer)
+	if err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+// SwappableDestinations are Destinations that can be replaced while files
+// are being tailed.
+type SwappableDestinations struct {
+	logger *log.Logger
+
+	lock         sync.RWMutex
+	destinations *Destinations
+}
+
+func NewSwappableDestinations(logger *log.Logger, destinations *Destinations) *SwappableDestinations {
+	return &SwappableDestinations{logger: logger, destinations: destinations}
+}
+
+// For returns the drainer for the messages read by the named source.
+func (s *SwappableDestinations) For(source string) syslog.Drainer {
+	return &sourceDrainer{destinations: s, source: source}
+}
+
+type sourceDrainer struct {
+	destinations *SwappableDestinations
+	source       string
+}
+
+func (d *sourceDrainer) Drain(message syslog.Message) error {
+	return d.destinations.drain(d.source, message)
+}
+
+// drain sends message to the current destinations. A message that was being
+// sent to destinations while they were swapped out is sent again to their
+// replacement.
+func (s *SwappableDestinations) drain(source string, message syslog.Message) error {
+	for {
+		s.lock.RLock()
+		destinations := s.destinations
+		s.lock.RUnlock()
+
+		err := destinations.Drain(source, message)
+		if !errors.Is(err, syslog.ErrClosed) {
+			return err
+		}
+	}
+}
+
+func (s *SwappableDestinations) Flush() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.destinations.Flush()
+}
+
+// Close makes a last attempt at sending the messages held back and closes
+// the destinations, leaving the messages that were not replayed from a spool
+// for the next run.
+func (s *SwappableDestinations) Close() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.destinations.Close()
+}
+
+// Swap closes the current destinations and replaces them with the ones build
+// returns. The current destinations are closed first, so that one that is
+// down does not hold up the swap and a spool is never used by two drainers at
+// once. Messages drained meanwhile wait for the replacement. Messages a group
+// held back and could not send are sent to the group replacing it, the one
+// with the same name or position. If build fails, the closed destinations are
+// left in place and Swap returns the error, after which the
+// SwappableDestinations must not be used.
+func (s *SwappableDestinations) Swap(build func() (*Destinations, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := s.destinations
+	closeErrs := current.close()
+
+	destinations, err := build()
+	if err != nil {
+		return err
+	}
+	s.destinations = destinations
+
+	for i, closeErr := range closeErrs {
+		if closeErr == nil {
+			continue
+		}
+		s.logger.Printf("could not send all messages to the previous destinations: %s\n", closeErr)
+
+		group := destinations.group(current.names[i], i)
+		for _, message := range syslog.Unsent(closeErr) {
+			if err := group.Drain(message); err != nil {
+				s.logger.Printf("could not send a message held back for the previous destinations: %s\n", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package blackbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Ways a source finds new files.
+const (
+	// DiscoveryPoll scans the source dir every POLL_INTERVAL, and tailers poll
+	// their file every second.
+	DiscoveryPoll = "poll"
+	// DiscoveryNotify watches every directory of the source for new entries,
+	// and tailers are woken up by the events on their file. If the
+	// directories cannot be watched, the source falls back to polling.
+	DiscoveryNotify = "notify"
+)
+
+func validateDiscovery(discovery string) error {
+	switch discovery {
+	case "", DiscoveryPoll, DiscoveryNotify:
+		return nil
+	default:
+		return fmt.Errorf("unknown discovery mode %q, must be %s or %s", discovery, DiscoveryPoll, DiscoveryNotify)
+	}
+}
+
+// updateNotifier starts or stops watching directories when the discovery
+// mode changed. It must be called with the lock held.
+func (f *fileWatcher) updateNotifier() {
+	if f.source.Discovery != DiscoveryNotify || f.notifyFailed {
+		f.closeNotifier()
+		return
+	}
+	if f.notifier != nil {
+		return
+	}
+
+	notifier, err := fsnotify.NewWatcher()
+	if err != nil {
+		f.fallBackToPolling(err)
+		return
+	}
+	f.notifier = notifier
+	f.notifying.Store(true)
+}
+
+// watchDir makes new entries of dir show up as events. It must be called with
+// the lock held.
+func (f *fileWatcher) watchDir(dir string) {
+	if f.notifier == nil {
+		return
+	}
+	if err := f.notifier.Add(dir); err != nil {
+		f.fallBackToPolling(err)
+	}
+}
+
+// fallBackToPolling must be called with the lock held.
+func (f *fileWatcher) fallBackToPolling(err error) {
+	f.logger.Printf("could not watch source dir %s for new files, falling back to polling: %s\n", f.source.Dir, err)
+	f.notifyFailed = true
+	f.closeNotifier()
+}
+
+// closeNotifier wakes up the tailers so that they go back to reading their
+// file every FILE_POLL_INTERVAL. It must be called with the lock held.
+func (f *fileWatcher) closeNotifier() {
+	if f.notifier != nil {
+		f.notifier.Close()
+		f.notifier = nil
+		f.notifying.Store(false)
+		for _, tailer := range f.tailers {
+			tailer.wake()
+		}
+	}
+}
+
+// wait returns once the source dir is due to be scanned again, tailing the
+// new files notifier reports in the meantime, and forgetting the tailers that
+// stopped and the checkpoints of removed files every POLL_INTERVAL. It returns
+// false once the watcher is stopped.
+func (f *fileWatcher) wait(notifier *fsnotify.Watcher) bool {
+	if notifier == nil {
+		select {
+		case <-time.After(POLL_INTERVAL):
+			return true
+		case <-f.rescan:
+			return true
+		case <-f.stop:
+			return false
+		}
+	}
+
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.lock.Lock()
+			f.forget()
+			if f.checkpoints != nil {
+				f.checkpoints.Prune()
+			}
+			f.lock.Unlock()
+		case event, ok := <-notifier.Events:
+			if !ok || !f.handleEvent(event) {
+				return true
+			}
+		case err := <-notifier.Errors:
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				f.logger.Printf("missed file events in source dir %s, scanning it again\n", f.source.Dir)
+			} else {
+				f.lock.Lock()
+				f.fallBackToPolling(err)
+				f.lock.Unlock()
+			}
+			return true
+		case <-f.rescan:
+			return true
+		case <-f.stop:
+			return false
+		}
+	}
+}
+
+// handleEvent wakes up the tailer of a file that changed, tails the file an
+// event reports as created, or the files in a created directory, and tails
+// the file of an evicted tailer again once it is written to. It returns false
+// if directories can no longer be watched.
+func (f *fileWatcher) handleEvent(event fsnotify.Event) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tailer, found := f.tailers[event.Name]
+	evicted := found && tailer.eviction() != nil
+	if found && !evicted {
+		tailer.wake()
+	}
+	if !event.Has(fsnotify.Create) && !(evicted && event.Has(fsnotify.Write)) {
+		return f.notifier != nil
+	}
+
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		// removed again before it could be looked at
+		return f.notifier != nil
+	}
+	relativePath, err := filepath.Rel(f.source.Dir, event.Name)
+	if err != nil {
+		return f.notifier != nil
+	}
+
+	if info.IsDir() {
+		f.findLogsToWatch(topLevelDir(relativePath), event.Name, info)
+	} else if f.watches(event.Name) {
+		f.track(event.Name)
+	}
+
+	return f.notifier != nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package blackbox
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileID(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Sys().(*syscall.Stat_t).Ino, nil
+}
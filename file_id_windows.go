@@ -0,0 +1,35 @@
+//go:build windows
+
+package blackbox
+
+import (
+	"syscall"
+)
+
+func fileID(path string) (uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	handle, err := syscall.CreateFile(
+		pathPtr,
+		0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS,
+		0,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(handle)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(handle, &info); err != nil {
+		return 0, err
+	}
+
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
@@ -1,15 +1,19 @@
 package blackbox
 
 import (
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+	"github.com/fsnotify/fsnotify"
+	"github.com/nxadm/tail"
 	"github.com/tedsuo/ifrit/grouper"
 
 	"code.cloudfoundry.org/blackbox/syslog"
@@ -17,84 +21,199 @@ import (
 
 const POLL_INTERVAL = 5 * time.Second
 
+// REMOVED_FILE_GRACE_PERIOD is how long a removed file that is recreated, as
+// when it is rotated, is still read from its beginning.
+const REMOVED_FILE_GRACE_PERIOD = time.Minute
+
 type fileWatcher struct {
 	logger *log.Logger
 
-	sourceDir          string
-	logFilename        bool
+	// lock guards the settings Reload changes and the tailers.
+	lock               sync.Mutex
+	source             SourceConfig
+	patterns           filePatterns
 	dynamicGroupClient grouper.DynamicClient
-	hostname           string
-	maxMessageSize     int
-	structuredData     rfc5424.StructuredData
-	excludeFilePattern string
+	checkpoints        *CheckpointStore
+	priorities         *PriorityResolver
+	multiline          []*MultilineRule
+
+	drainer      syslog.Drainer
+	tailers      map[string]*Tailer
+	notifier     *fsnotify.Watcher
+	notifyFailed bool
+	// notifying tells the tailers whether notifier is set, without the lock.
+	notifying atomic.Bool
 
-	drain syslog.Drain
+	scanned chan struct{}
+	rescan  chan struct{}
+	stop    chan struct{}
 }
 
 func NewFileWatcher(
 	logger *log.Logger,
-	sourceDir string,
-	logFilename bool,
+	source SourceConfig,
 	dynamicGroupClient grouper.DynamicClient,
-	drain syslog.Drain,
-	hostname string,
-	maxMessageSize int,
-	structuredData rfc5424.StructuredData,
-	excludeFilePattern string,
+	drainer syslog.Drainer,
+	checkpoints *CheckpointStore,
+	priorities *PriorityResolver,
+	multiline []*MultilineRule,
 ) *fileWatcher {
 	return &fileWatcher{
 		logger:             logger,
-		sourceDir:          sourceDir,
-		logFilename:        logFilename,
+		source:             source,
+		patterns:           source.filePatterns(),
 		dynamicGroupClient: dynamicGroupClient,
-		drain:              drain,
-		hostname:           hostname,
-		structuredData:     structuredData,
-		maxMessageSize:     maxMessageSize,
-		excludeFilePattern: excludeFilePattern,
+		drainer:            drainer,
+		checkpoints:        checkpoints,
+		priorities:         priorities,
+		multiline:          multiline,
+		tailers:            map[string]*Tailer{},
+		scanned:            make(chan struct{}),
+		rescan:             make(chan struct{}, 1),
+		stop:               make(chan struct{}),
 	}
 }
 
+// Scanned is closed once the source dir has been scanned for the first time,
+// so that every file present at startup is being tailed.
+func (f *fileWatcher) Scanned() <-chan struct{} {
+	return f.scanned
+}
+
 func (f *fileWatcher) Watch() {
+	defer func() {
+		f.lock.Lock()
+		f.closeNotifier()
+		f.lock.Unlock()
+	}()
+
 	for {
-		logDirs, err := os.ReadDir(f.sourceDir)
+		f.lock.Lock()
+		select {
+		case <-f.stop:
+			f.lock.Unlock()
+			return
+		default:
+		}
+		f.updateNotifier()
+		f.watchDir(f.source.Dir)
+		logDirs, err := os.ReadDir(f.source.Dir)
 		if err != nil {
 			f.logger.Fatalf("could not list directories in source dir: %s\n", err)
 		}
 
 		for _, logDir := range logDirs {
 			tag := logDir.Name()
-			tagDirPath := filepath.Join(f.sourceDir, tag)
+			tagDirPath := filepath.Join(f.source.Dir, tag)
 
 			fileInfo, err := os.Stat(tagDirPath)
 			if err != nil {
 				f.logger.Fatalf("failed to determine if path is directory: %s\n", err)
 			}
 
-			if !fileInfo.IsDir() {
-				continue
+			f.findLogsToWatch(tag, tagDirPath, fileInfo)
+
+		}
+
+		f.forget()
+		select {
+		case <-f.scanned:
+		default:
+			close(f.scanned)
+		}
+		if f.checkpoints != nil {
+			f.checkpoints.Prune()
+		}
+		notifier := f.notifier
+		f.lock.Unlock()
+
+		if !f.wait(notifier) {
+			return
+		}
+	}
+}
+
+// Reload applies changed settings. Files that are no longer watched stop
+// being tailed, files that still are keep being tailed from where they are
+// with the new settings, and files that are now watched are picked up by a
+// scan right away. A changed discovery mode or start position applies to
+// files tailed from then on.
+func (f *fileWatcher) Reload(source SourceConfig, priorities *PriorityResolver, multiline []*MultilineRule) {
+	f.lock.Lock()
+	if source.Discovery != f.source.Discovery {
+		f.notifyFailed = false
+	}
+	f.source = source
+	f.patterns = source.filePatterns()
+	f.priorities = priorities
+	f.multiline = multiline
+
+	for path, tailer := range f.tailers {
+		process, found := f.dynamicGroupClient.Get(path)
+		if !f.watches(path) {
+			if found {
+				f.logger.Printf("Stopping to tail file: %s", path)
+				process.Signal(os.Interrupt)
+			}
+			f.untrack(path)
+			continue
+		}
+		if !found {
+			// evicted tailers are replaced by new ones with the new settings
+			if tailer.eviction() == nil {
+				f.untrack(path)
 			}
+			continue
+		}
+		f.configure(tailer)
+	}
+	f.lock.Unlock()
 
-			f.findLogsToWatch(tag, tagDirPath, fileInfo)
+	select {
+	case f.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops scanning the source dir and tailing its files.
+func (f *fileWatcher) Stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
+	close(f.stop)
+	for path := range f.tailers {
+		if process, found := f.dynamicGroupClient.Get(path); found {
+			f.logger.Printf("Stopping to tail file: %s", path)
+			process.Signal(os.Interrupt)
 		}
+	}
+	f.tailers = map[string]*Tailer{}
+	watchedFiles.Set(0, f.source.name())
+}
 
-		time.Sleep(POLL_INTERVAL)
+// watches tells whether a scan would pick up the file at path.
+func (f *fileWatcher) watches(path string) bool {
+	relativePath, err := filepath.Rel(f.source.Dir, path)
+	if err != nil || !filepath.IsLocal(relativePath) {
+		return false
+	}
+	if filepath.Dir(relativePath) == "." && f.source.TagStrategy != TagStrategyFixed {
+		return false
 	}
+	return f.patterns.match(filepath.ToSlash(relativePath))
 }
 
 func (f *fileWatcher) findLogsToWatch(tag string, filePath string, file fs.FileInfo) {
 	if !file.IsDir() {
-		if strings.HasSuffix(file.Name(), ".log") {
-			if matched, _ := filepath.Match(f.excludeFilePattern, file.Name()); matched {
-				return
-			}
-			if _, found := f.dynamicGroupClient.Get(filePath); !found {
-				f.dynamicGroupClient.Inserter() <- f.memberForFile(filePath)
-			}
+		if f.watches(filePath) {
+			f.track(filePath)
 		}
 		return
 	}
+	if relativePath, err := filepath.Rel(f.source.Dir, filePath); err == nil && f.patterns.excludesDir(filepath.ToSlash(relativePath)) {
+		return
+	}
+	f.watchDir(filePath)
 
 	dirContents, err := os.ReadDir(filePath)
 	if err != nil {
@@ -111,33 +230,137 @@ func (f *fileWatcher) findLogsToWatch(tag string, filePath string, file fs.FileI
 	}
 }
 
-func (f *fileWatcher) memberForFile(logfilePath string) grouper.Member {
-	drainer, err := syslog.NewDrainer(f.logger, f.drain, f.hostname, f.structuredData, f.maxMessageSize)
-	if err != nil {
-		f.logger.Fatalf("could not drain to syslog: %s\n", err)
+// track tails the file at path unless it already is. A file whose tailer was
+// evicted is tailed again once it is recreated or grows, from where the
+// tailer left off.
+func (f *fileWatcher) track(path string) {
+	if _, found := f.dynamicGroupClient.Get(path); found {
+		return
+	}
+
+	var location *tail.SeekInfo
+	if tailer, found := f.tailers[path]; found {
+		if evicted := tailer.eviction(); evicted != nil {
+			offset, resume := evicted.resumeAt(path)
+			if !resume {
+				return
+			}
+			location = &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+		}
+	}
+	f.dynamicGroupClient.Inserter() <- f.memberForFile(path, location)
+}
+
+// untrack drops the tailer of path along with the metrics of its file. It
+// must be called with the lock held.
+func (f *fileWatcher) untrack(path string) {
+	if tailer, found := f.tailers[path]; found {
+		tailer.deleteMetrics()
+		delete(f.tailers, path)
 	}
+}
+
+// forget drops the tailers that stopped for good: those of files that are
+// gone, and those of removed files that were not recreated in time. It must
+// be called with the lock held.
+func (f *fileWatcher) forget() {
+	watched := 0
+	for path, tailer := range f.tailers {
+		if _, found := f.dynamicGroupClient.Get(path); found {
+			watched++
+			continue
+		}
 
-	tag := f.determineTag(logfilePath)
-	tag = f.formatSyslogAppName(tag, logfilePath)
+		_, err := os.Stat(path)
+		evicted := tailer.eviction()
+		if evicted == nil {
+			if err != nil {
+				f.untrack(path)
+			}
+			continue
+		}
+		if !evicted.removed {
+			if err == nil {
+				continue
+			}
+			// an idle file was removed since
+			evicted = &eviction{removed: true, at: time.Now()}
+			tailer.evict(evicted)
+		}
+		if time.Since(evicted.at) >= REMOVED_FILE_GRACE_PERIOD {
+			f.untrack(path)
+		}
+	}
+	watchedFiles.Set(float64(watched), f.source.name())
+}
 
+func (f *fileWatcher) memberForFile(logfilePath string, location *tail.SeekInfo) grouper.Member {
 	tailer := &Tailer{
-		Path:    logfilePath,
-		Tag:     tag,
-		Drainer: drainer,
-		Logger:  f.logger,
+		Path:        logfilePath,
+		Drainer:     f.drainer,
+		Logger:      f.logger,
+		Checkpoints: f.checkpoints,
+		Notified:    f.notifying.Load,
+		Location:    location,
+		FromStart:   f.readsFromStart(),
+		wakeup:      make(chan struct{}, 1),
 	}
+	f.configure(tailer)
+	f.tailers[logfilePath] = tailer
 
 	return grouper.Member{Name: tailer.Path, Runner: tailer}
 }
 
+// readsFromStart tells whether a file tailed now is read from its beginning
+// when it has no checkpoint. It must be called with the lock held.
+func (f *fileWatcher) readsFromStart() bool {
+	switch f.source.StartPosition {
+	case StartPositionBeginning:
+		return true
+	case StartPositionBeginningForNewFiles:
+		select {
+		case <-f.scanned:
+			return true
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
+
+// configure sets how the tailer tags, prioritizes and groups the lines of its
+// file.
+func (f *fileWatcher) configure(tailer *Tailer) {
+	relativePath, err := filepath.Rel(f.source.Dir, tailer.Path)
+	if err != nil {
+		f.logger.Fatalf("could not compute relative path of %s: %s\n", tailer.Path, err)
+	}
+
+	// overrides and multiline rules match on the sub-directory of the file,
+	// or on the tag of a fixed source
+	tag := f.determineTag(tailer.Path)
+	ruleTag := topLevelDir(relativePath)
+	if f.source.TagStrategy == TagStrategyFixed {
+		ruleTag = tag
+	}
+	tag = f.formatSyslogAppName(tag, tailer.Path)
+
+	tailer.Update(tag, f.priorities.Resolve(ruleTag, relativePath), f.priorities, findMultilineRule(f.multiline, ruleTag), f.source.IdleTimeout)
+}
+
 func (f *fileWatcher) determineTag(logfilePath string) string {
+	if f.source.TagStrategy == TagStrategyFixed {
+		return f.source.Tag
+	}
+
 	var tag string
 	var err error
-	if f.logFilename {
-		tag, err = filepath.Rel(f.sourceDir, logfilePath)
+	if f.source.LogFilename {
+		tag, err = filepath.Rel(f.source.Dir, logfilePath)
 	} else {
 		logfileDir := filepath.Dir(logfilePath)
-		tag, err = filepath.Rel(f.sourceDir, logfileDir)
+		tag, err = filepath.Rel(f.source.Dir, logfileDir)
 	}
 	if err != nil {
 		f.logger.Fatalf("could not compute tag from file path %s: %s\n", logfilePath, err)
@@ -159,9 +382,16 @@ func (f *fileWatcher) formatSyslogAppName(originalAppname string, logfilePath st
 		f.logger.Printf("App-name consisted of chars outside of ASCII 33 to 126. app-name : %s, path: %s", originalAppname, logfilePath)
 	}
 
-	if len(appname) > 48 {
+	if len(appname) > syslog.MaxAppNameLength {
 		f.logger.Printf("App-name was too long. Trimmed it to 48 Characters according to syslog formating rules, app-name : %s, path: %s", originalAppname, logfilePath)
-		appname = appname[0:48]
+		appname = appname[0:syslog.MaxAppNameLength]
 	}
 	return appname
 }
+
+// topLevelDir returns the sub-directory of the source dir a file is in, which
+// is what tag based settings are matched against.
+func topLevelDir(relativePath string) string {
+	dir, _, _ := strings.Cut(filepath.ToSlash(relativePath), "/")
+	return dir
+}
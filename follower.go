@@ -0,0 +1,313 @@
+package blackbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nxadm/tail"
+)
+
+const (
+	// FILE_POLL_INTERVAL is how often a tailer that is not notified of writes
+	// reads its file for new lines.
+	FILE_POLL_INTERVAL = time.Second
+
+	// ROTATION_GRACE_PERIOD is how long a file is still read after it was
+	// renamed or removed, for the lines written to it by processes that have
+	// not reopened their log yet.
+	ROTATION_GRACE_PERIOD = 5 * time.Second
+
+	// recentSize is how many of the last bytes read are kept to recognize the
+	// copy of a file rotated with copytruncate.
+	recentSize = 256
+)
+
+// What a follower found when checking whether its file was rotated.
+type rotation int
+
+const (
+	notRotated rotation = iota
+	// rotating means the path no longer refers to the file, which is still
+	// being read during the grace period.
+	rotating
+	// switched means the follower moved on to the new file at the path.
+	switched
+	// truncated means the file is read from its beginning again.
+	truncated
+	// removed means no file was created at the path within the grace period.
+	removed
+)
+
+// A follower reads the lines appended to a file. When the file is renamed, as
+// logrotate does with its create strategy, the follower keeps reading it for
+// ROTATION_GRACE_PERIOD before it switches to the new file at the path. When
+// the file is truncated, as with copytruncate, the lines it had not read yet
+// are read from the copy next to it if there is one, as are the lines of a
+// file that was rotated while blackbox was down.
+type follower struct {
+	path   string
+	logger *log.Logger
+
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+	recent  []byte
+	head    []byte
+	size    int64
+	modTime time.Time
+	rotated time.Time
+
+	// leftover is the unterminated last line of a file that was moved on
+	// from, which is returned as a line of its own.
+	leftover []byte
+	// copied is the copy of a truncated file, or the file rotated while
+	// blackbox was down, which is read up to its end before the file itself.
+	copied       io.Closer
+	copiedReader *bufio.Reader
+}
+
+func openFollower(path string, location *tail.SeekInfo, logger *log.Logger) (*follower, error) {
+	f := &follower{path: path, logger: logger}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	offset, err := f.file.Seek(location.Offset, location.Whence)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.offset = offset
+
+	// what was read before, to tell whether the file is rewritten
+	recent := make([]byte, min(offset, recentSize))
+	if n, err := f.file.ReadAt(recent, offset-int64(len(recent))); err == nil {
+		f.recent = recent[:n]
+	}
+	return f, nil
+}
+
+// open opens the file at the path, closing the one read so far.
+func (f *follower) open() error {
+	file, err := tail.OpenFile(f.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.info = info
+	f.reader = bufio.NewReader(file)
+	f.offset = 0
+	f.partial = nil
+	f.recent = nil
+	f.head = nil
+	f.size = 0
+	f.modTime = time.Time{}
+	f.rotated = time.Time{}
+	return nil
+}
+
+// catchUp makes the rest of the file that was rotated while blackbox was down
+// be read before the file at the path.
+func (f *follower) catchUp(rotated *rotatedFile) {
+	f.copied = rotated
+	f.copiedReader = bufio.NewReader(rotated)
+}
+
+func (f *follower) Close() error {
+	if f.copied != nil {
+		f.copied.Close()
+	}
+	return f.file.Close()
+}
+
+// fingerprint returns the first headSize bytes of the file, or all of them
+// while it is shorter.
+func (f *follower) fingerprint() []byte {
+	if len(f.head) < headSize {
+		head := make([]byte, headSize)
+		n, _ := f.file.ReadAt(head, 0)
+		f.head = head[:n]
+	}
+	return f.head
+}
+
+// rotating tells whether the file is being read during its grace period.
+func (f *follower) rotating() bool {
+	return !f.rotated.IsZero()
+}
+
+// readLine returns the next complete line and the offset in the file after
+// it, or false if there is none yet. Lines that are not from the file at the
+// path come with the offset it is read from.
+func (f *follower) readLine() (string, int64, bool, error) {
+	if len(f.leftover) > 0 {
+		line := string(f.leftover)
+		f.leftover = nil
+		return line, f.offset, true, nil
+	}
+
+	if f.copied != nil {
+		data, err := f.copiedReader.ReadBytes('\n')
+		if err == nil {
+			return strings.TrimSuffix(string(data), "\n"), f.offset, true, nil
+		}
+		f.copied.Close()
+		f.copied = nil
+		f.copiedReader = nil
+		// the copy is complete, so its unterminated last line is too
+		if len(data) > 0 {
+			return string(data), f.offset, true, nil
+		}
+	}
+
+	data, err := f.reader.ReadBytes('\n')
+	if err == io.EOF {
+		f.partial = append(f.partial, data...)
+		return "", f.offset, false, nil
+	}
+	if err != nil {
+		return "", f.offset, false, err
+	}
+
+	line := append(f.partial, data...)
+	f.partial = nil
+	f.offset += int64(len(line))
+	recent := append(f.recent, line...)
+	f.recent = bytes.Clone(recent[max(0, len(recent)-recentSize):])
+	return strings.TrimSuffix(string(line), "\n"), f.offset, true, nil
+}
+
+// check tells whether the file was rotated, and moves on to the file to read
+// next if it was. It is called before reading new lines, so that a truncated
+// file is not read from where the old contents ended.
+func (f *follower) check() (rotation, error) {
+	info, err := os.Stat(f.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return notRotated, err
+	}
+
+	if err == nil && os.SameFile(info, f.info) {
+		f.rotated = time.Time{}
+		if f.rewritten(info) {
+			f.truncate()
+			return truncated, nil
+		}
+		return notRotated, nil
+	}
+
+	if f.rotated.IsZero() {
+		f.logger.Printf("File %s was moved or removed, reading it for %s before moving on", f.path, ROTATION_GRACE_PERIOD)
+		f.rotated = time.Now()
+	}
+	if time.Since(f.rotated) < ROTATION_GRACE_PERIOD {
+		return rotating, nil
+	}
+	// lines written to the old file since it was last read come first
+	if info, err := f.file.Stat(); err == nil && info.Size() > f.offset+int64(len(f.partial)) {
+		return rotating, nil
+	}
+
+	leftover := f.partial
+	if err != nil {
+		f.leftover = leftover
+		f.partial = nil
+		return removed, nil
+	}
+	if err := f.open(); err != nil {
+		return notRotated, err
+	}
+	f.leftover = leftover
+	f.logger.Printf("Switching to the new file at %s", f.path)
+	return switched, nil
+}
+
+// rewritten tells whether the file was truncated since it was last checked,
+// either because it is shorter than what was read, or because it no longer
+// has what was read last, having been written to again after the truncation.
+func (f *follower) rewritten(info os.FileInfo) bool {
+	if info.Size() < f.offset+int64(len(f.partial)) {
+		return true
+	}
+	if info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+		return false
+	}
+	f.size = info.Size()
+	f.modTime = info.ModTime()
+
+	recent := make([]byte, len(f.recent))
+	if _, err := f.file.ReadAt(recent, f.offset-int64(len(recent))); err != nil {
+		return false
+	}
+	return !bytes.Equal(recent, f.recent)
+}
+
+// truncate reads the file from its beginning again, after the lines that the
+// copy a copytruncate rotation made of it has past what was read.
+func (f *follower) truncate() {
+	f.logger.Printf("File %s was truncated, reading it from its beginning", f.path)
+
+	if copied := f.findCopy(); copied != nil {
+		f.logger.Printf("Reading the rest of %s from its copy %s", f.path, copied.Name())
+		f.copied = copied
+		f.copiedReader = bufio.NewReader(copied)
+	} else {
+		f.leftover = f.partial
+	}
+
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		f.logger.Printf("could not seek to the beginning of %s: %s", f.path, err)
+	}
+	f.reader.Reset(f.file)
+	f.offset = 0
+	f.partial = nil
+	f.recent = nil
+	f.head = nil
+	f.size = 0
+	f.modTime = time.Time{}
+}
+
+// findCopy returns the file the truncated one was copied to, whose contents
+// match the last bytes read, opened where the follower got to.
+func (f *follower) findCopy() *os.File {
+	if len(f.recent) == 0 {
+		return nil
+	}
+
+	var copied *os.File
+	searchRotated(f.path, func(candidatePath string, info os.FileInfo) bool {
+		if info.Size() < f.offset {
+			return false
+		}
+		file, err := tail.OpenFile(candidatePath)
+		if err != nil {
+			return false
+		}
+		recent := make([]byte, len(f.recent))
+		if _, err := file.ReadAt(recent, f.offset-int64(len(recent))); err == nil && bytes.Equal(recent, f.recent) {
+			if _, err := file.Seek(f.offset, io.SeekStart); err == nil {
+				copied = file
+				return true
+			}
+		}
+		file.Close()
+		return false
+	})
+	return copied
+}
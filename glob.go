@@ -0,0 +1,59 @@
+package blackbox
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// matchGlob tells whether the slash separated path name matches pattern. A
+// ** segment of the pattern matches any number of directories, including
+// none, and the other segments are matched as by path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validateGlob checks that pattern can be matched against paths relative to
+// a source dir.
+func validateGlob(pattern string) error {
+	if pattern == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return errors.New("must be relative to the source dir")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
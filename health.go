@@ -0,0 +1,64 @@
+package blackbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/blackbox/syslog"
+)
+
+const defaultHealthCheckWindow = 5 * time.Minute
+
+type healthStatus struct {
+	Status       string                     `json:"status"`
+	Destinations []syslog.DestinationStatus `json:"destinations"`
+}
+
+// HealthHandler serves /healthz, which reports whether every destination is
+// healthy, and /readyz, which reports whether the files present at startup
+// are being tailed.
+type HealthHandler struct {
+	scanned <-chan struct{}
+	window  time.Duration
+}
+
+func NewHealthHandler(scanned <-chan struct{}, window time.Duration) *HealthHandler {
+	if window == 0 {
+		window = defaultHealthCheckWindow
+	}
+	return &HealthHandler{scanned: scanned, window: window}
+}
+
+func (h *HealthHandler) Healthz(w http.ResponseWriter, _ *http.Request) {
+	status := healthStatus{Status: "ok", Destinations: syslog.DestinationStatuses()}
+
+	now := time.Now()
+	for _, destination := range status.Destinations {
+		if !destination.Healthy(h.window, now) {
+			status.Status = "unhealthy"
+		}
+	}
+
+	writeStatus(w, status, status.Status == "ok")
+}
+
+func (h *HealthHandler) Readyz(w http.ResponseWriter, _ *http.Request) {
+	status := healthStatus{Status: "ready", Destinations: syslog.DestinationStatuses()}
+
+	select {
+	case <-h.scanned:
+	default:
+		status.Status = "not ready"
+	}
+
+	writeStatus(w, status, status.Status == "ready")
+}
+
+func writeStatus(w http.ResponseWriter, status healthStatus, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status) //nolint:errcheck
+}
@@ -113,6 +113,10 @@ func (runner *BlackboxRunner) Stop() {
 	ginkgomon.Kill(runner.blackboxProcess)
 }
 
+func (runner *BlackboxRunner) Interrupt() {
+	ginkgomon.Interrupt(runner.blackboxProcess, "5s")
+}
+
 func CreateConfigFile(config blackbox.Config) string {
 	configFile, err := os.CreateTemp("", "blackbox_config")
 	Expect(err).NotTo(HaveOccurred())
@@ -0,0 +1,96 @@
+package integration_test
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+
+	"code.cloudfoundry.org/blackbox/syslog"
+)
+
+// Run with: go test ./integration -run '^$' -bench Drain
+func BenchmarkDrain(b *testing.B) {
+	for _, transport := range []string{"tcp", "tls"} {
+		b.Run(transport+"/unbatched", func(b *testing.B) {
+			benchmarkDrain(b, transport, 1)
+		})
+		b.Run(transport+"/batched", func(b *testing.B) {
+			benchmarkDrain(b, transport, 0)
+		})
+	}
+}
+
+func benchmarkDrain(b *testing.B, transport string, batchSize int) {
+	listener := listenAndDiscard(b, transport)
+	defer listener.Close()
+
+	drainer, err := syslog.NewDrainer(
+		log.New(io.Discard, "", 0),
+		syslog.Drain{
+			Transport: transport,
+			Address:   listener.Addr().String(),
+			CA:        "./fixtures/ca.crt",
+			BatchSize: batchSize,
+		},
+		"benchmark-host",
+		rfc5424.StructuredData{},
+		99990,
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	message := syslog.Message{
+		Line: "2026-10-18T12:00:00.000Z INFO [main] handled request GET /v2/info in 1.2ms status=200",
+		Tag:  "benchmark",
+		Path: "/var/vcap/sys/log/benchmark/benchmark.log",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		if err := drainer.Drain(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := drainer.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+}
+
+func listenAndDiscard(b *testing.B, transport string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if transport == "tls" {
+		cert, err := tls.LoadX509KeyPair("fixtures/server.crt", "fixtures/server.key")
+		if err != nil {
+			b.Fatal(err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}) //nolint:gosec
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return listener
+}
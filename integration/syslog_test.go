@@ -1,13 +1,24 @@
 package integration_test
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -15,6 +26,7 @@ import (
 	"github.com/onsi/gomega/gexec"
 	"github.com/tedsuo/ifrit"
 	ginkgomon "github.com/tedsuo/ifrit/ginkgomon_v2"
+	"gopkg.in/yaml.v3"
 
 	sl "github.com/ziutek/syslog"
 
@@ -155,6 +167,179 @@ var _ = Describe("Blackbox", func() {
 			Expect(message.Severity).To(Equal(sl.Info))
 		})
 
+		Context("when a priority is configured", func() {
+			It("creates messages with the configured facility and severity", func() {
+				config := buildConfig(logDir)
+				config.Syslog.Facility = "local0"
+				config.Syslog.Severity = "notice"
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Facility).To(Equal(sl.Local0))
+				Expect(message.Severity).To(Equal(sl.Notice))
+
+				blackboxRunner.Stop()
+			})
+
+			It("applies the first matching override", func() {
+				config := buildConfig(logDir)
+				config.Syslog.Facility = "local0"
+				config.Syslog.PriorityOverrides = []blackbox.PriorityOverride{
+					{FilePattern: "*/other.log", Severity: "debug"},
+					{FilePattern: "*/" + logfileName, Severity: "err"},
+					{Tag: tagName, Facility: "authpriv", Severity: "warning"},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Facility).To(Equal(sl.Local0))
+				Expect(message.Severity).To(Equal(sl.Err))
+
+				blackboxRunner.Stop()
+			})
+
+			It("matches overrides and multiline rules on the tag of a fixed source", func() {
+				config := buildConfig(logDir)
+				config.Syslog.SourceDir = ""
+				config.Syslog.ExcludeFilePattern = ""
+				config.Syslog.Sources = []blackbox.SourceConfig{
+					{
+						Dir:         filepath.Join(logDir, tagName),
+						TagStrategy: blackbox.TagStrategyFixed,
+						Tag:         "my-app",
+					},
+				}
+				config.Syslog.PriorityOverrides = []blackbox.PriorityOverride{
+					{Tag: tagName, Severity: "debug"},
+					{Tag: "my-app", Facility: "authpriv", Severity: "warning"},
+				}
+				config.Syslog.Multiline = []blackbox.MultilineConfig{
+					{Tag: "my-app", ContinuationPattern: `^\s`},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "panic: something broke\n", false, false)
+				Write(logFile, "\tat main.go:12\n", false, false)
+				Write(logFile, "recovered\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("my-app"))
+				Expect(message.Facility).To(Equal(sl.Authpriv))
+				Expect(message.Severity).To(Equal(sl.Warning))
+				Expect(message.Content).To(ContainSubstring("panic: something broke\n\tat main.go:12"))
+
+				blackboxRunner.Stop()
+			})
+
+			It("matches overrides by tag", func() {
+				config := buildConfig(logDir)
+				config.Syslog.PriorityOverrides = []blackbox.PriorityOverride{
+					{Tag: "other-tag", Severity: "debug"},
+					{Tag: tagName, Facility: "authpriv", Severity: "warning"},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Facility).To(Equal(sl.Authpriv))
+				Expect(message.Severity).To(Equal(sl.Warning))
+
+				blackboxRunner.Stop()
+			})
+		})
+
+		Context("when severity rules are configured", func() {
+			It("sets the severity of lines matching a rule", func() {
+				config := buildConfig(logDir)
+				config.Syslog.Facility = "local0"
+				config.Syslog.SeverityRules = []blackbox.SeverityRule{
+					{Pattern: `\bERROR\b`, Severity: "err"},
+					{Pattern: `"level":"warn"`, Severity: "warning"},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "an ERROR occurred\n", false, false)
+				Write(logFile, `{"level":"warn","msg":"careful"}`+"\n", false, false)
+				Write(logFile, "all is well\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("an ERROR occurred"))
+				Expect(message.Facility).To(Equal(sl.Local0))
+				Expect(message.Severity).To(Equal(sl.Err))
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("careful"))
+				Expect(message.Facility).To(Equal(sl.Local0))
+				Expect(message.Severity).To(Equal(sl.Warning))
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("all is well"))
+				Expect(message.Facility).To(Equal(sl.Local0))
+				Expect(message.Severity).To(Equal(sl.Info))
+
+				blackboxRunner.Stop()
+			})
+		})
+
+		Context("when multiline aggregation is configured", func() {
+			It("sends lines belonging to the same event as a single message", func() {
+				config := buildConfig(logDir)
+				config.Syslog.Multiline = []blackbox.MultilineConfig{
+					{Tag: "other-tag", ContinuationPattern: `.*`},
+					{Tag: tagName, StartPattern: `^\d{4}-\d{2}-\d{2} `},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "2026-01-02 panic: something broke\n", false, false)
+				Write(logFile, "\tat main.go:12\n", false, false)
+				Write(logFile, "\tat main.go:34\n", false, false)
+				Write(logFile, "2026-01-02 recovered\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("panic: something broke\n\tat main.go:12\n\tat main.go:34"))
+				Expect(message.Content).NotTo(ContainSubstring("recovered"))
+
+				By("flushing the last event once no more lines arrive")
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("2026-01-02 recovered"))
+
+				blackboxRunner.Stop()
+			})
+
+			It("does not group more than max_lines lines into one message", func() {
+				config := buildConfig(logDir)
+				config.Syslog.Multiline = []blackbox.MultilineConfig{
+					{ContinuationPattern: `^\s`, MaxLines: 2, FlushTimeout: time.Minute},
+				}
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "first\n", false, false)
+				Write(logFile, " second\n", false, false)
+				Write(logFile, " third\n", false, false)
+				Write(logFile, " fourth\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("first\n second"))
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring(" third\n fourth"))
+
+				blackboxRunner.Stop()
+			})
+		})
+
 		It("creates messages with the expected procid", func() {
 			config := buildConfig(logDir)
 			blackboxRunner.StartWithConfig(config, 1)
@@ -323,6 +508,184 @@ var _ = Describe("Blackbox", func() {
 			blackboxRunner.Stop()
 		})
 
+		Context("when a state directory is configured", func() {
+			var stateDir string
+
+			BeforeEach(func() {
+				var err error
+				stateDir, err = os.MkdirTemp("", "blackbox-state")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(stateDir)
+			})
+
+			It("resumes from the last checkpoint after a restart", func() {
+				config := buildConfig(logDir)
+				config.StateDir = stateDir
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, false)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("hello"))
+
+				blackboxRunner.Interrupt()
+				Expect(filepath.Join(stateDir, "checkpoints.json")).To(BeAnExistingFile())
+
+				Write(logFile, "written while stopped\n", true, false)
+
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("written while stopped"))
+
+				Write(logFile, "world\n", true, true)
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("world"))
+
+				blackboxRunner.Stop()
+			})
+
+			It("does not checkpoint lines held back while the destination is down", func() {
+				address := fmt.Sprintf("127.0.0.1:%d", 9190+GinkgoParallelProcess())
+				configPath := CreateConfigFile(blackbox.Config{
+					Syslog: blackbox.SyslogConfig{
+						Destination: syslog.Drain{
+							Transport: "tcp",
+							Address:   address,
+						},
+						SourceDir: logDir,
+						// a file without a checkpoint is read again
+						StartPosition: blackbox.StartPositionBeginning,
+					},
+					StateDir: stateDir,
+				})
+				defer os.Remove(configPath)
+
+				session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+				Write(logFile, "written while the server is down\n", true, false)
+				Eventually(session.Err, "5s").Should(gbytes.Say("Error connecting"))
+				// past the next flush of the checkpoints
+				time.Sleep(2 * time.Second)
+				session.Interrupt()
+				Eventually(session, "5s").Should(gexec.Exit())
+
+				buffer := gbytes.NewBuffer()
+				server := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+				defer ginkgomon.Interrupt(server)
+
+				session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				defer func() {
+					session.Kill()
+					session.Wait()
+				}()
+
+				Eventually(buffer, "10s").Should(gbytes.Say("written while the server is down"))
+			})
+
+			It("reads a file replaced while it was stopped from its beginning", func() {
+				config := buildConfig(logDir)
+				config.StateDir = stateDir
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, false)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("hello"))
+
+				blackboxRunner.Interrupt()
+
+				logPath := logFile.Name()
+				logFile.Close()
+				Expect(os.Rename(logPath, logPath+".1")).To(Succeed())
+				var err error
+				logFile, err = os.Create(logPath)
+				Expect(err).NotTo(HaveOccurred())
+				Write(logFile, "written to the new file\n", true, false)
+
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("written to the new file"))
+
+				blackboxRunner.Stop()
+			})
+
+			It("catches up on a file rotated and compressed while it was stopped", func() {
+				config := buildConfig(logDir)
+				config.StateDir = stateDir
+				config.CatchUpRotated = true
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, false)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("hello"))
+
+				blackboxRunner.Interrupt()
+
+				Write(logFile, "written before the rotation\n", true, false)
+
+				logPath := logFile.Name()
+				logFile.Close()
+				contents, err := os.ReadFile(logPath)
+				Expect(err).NotTo(HaveOccurred())
+				compressed, err := os.Create(logPath + ".1.gz")
+				Expect(err).NotTo(HaveOccurred())
+				writer := gzip.NewWriter(compressed)
+				_, err = writer.Write(contents)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writer.Close()).To(Succeed())
+				Expect(compressed.Close()).To(Succeed())
+				Expect(os.Remove(logPath)).To(Succeed())
+
+				logFile, err = os.Create(logPath)
+				Expect(err).NotTo(HaveOccurred())
+				Write(logFile, "written after the rotation\n", true, false)
+
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("written before the rotation"))
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("written after the rotation"))
+
+				Write(logFile, "world\n", true, false)
+
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("world"))
+				Consistently(inbox.Messages).ShouldNot(Receive())
+
+				blackboxRunner.Stop()
+			})
+
+			It("seeks to the end of files it has no checkpoint for", func() {
+				Write(logFile, "already present\n", true, false)
+
+				config := buildConfig(logDir)
+				config.StateDir = stateDir
+				blackboxRunner.StartWithConfig(config, 1)
+
+				Write(logFile, "hello\n", true, true)
+
+				var message *sl.Message
+				Eventually(inbox.Messages, "5s").Should(Receive(&message))
+				Expect(message.Content).To(ContainSubstring("hello"))
+
+				blackboxRunner.Stop()
+			})
+		})
+
 		It("tracks logs in multiple files in subdirectories of source directory", func() {
 			anotherLogFile, err := os.OpenFile(
 				filepath.Join(logDir, tagName, "another-tail.log"),
@@ -670,70 +1033,1844 @@ var _ = Describe("Blackbox", func() {
 		})
 	})
 
-	Context("When the server uses tls", func() {
-		var address string
-		var buffer *gbytes.Buffer
-		var tlsserver TLSSyslogServer
-		var blackboxRunner *BlackboxRunner
+	Context("when several files are tailed", func() {
+		It("shares a single connection to the destination between them", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
 
-		BeforeEach(func() {
-			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
-			buffer = gbytes.NewBuffer()
-			tlsserver = TLSSyslogServer{
+			buffer := gbytes.NewBuffer()
+			server := &TcpSyslogServer{
 				Addr:   address,
 				Buffer: buffer,
 			}
-			err := tlsserver.Run()
-			Expect(err).ToNot(HaveOccurred())
-			blackboxRunner = NewBlackboxRunner(blackboxPath)
-		})
+			serverProcess := ginkgomon.Invoke(server)
+			defer ginkgomon.Interrupt(serverProcess)
 
-		AfterEach(func() {
-			tlsserver.Stop()
-		})
+			anotherLogFile, err := os.OpenFile(
+				filepath.Join(logDir, tagName, "another-tail.log"),
+				os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+				os.ModePerm,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer anotherLogFile.Close()
 
-		It("can send messages using tls", func() {
-			blackboxConfig := blackbox.Config{
-				Hostname: "",
+			config := blackbox.Config{
 				Syslog: blackbox.SyslogConfig{
 					Destination: syslog.Drain{
-						Transport: "tls",
+						Transport: "tcp",
 						Address:   address,
-						CA:        "./fixtures/ca.crt",
 					},
 					SourceDir: logDir,
 				},
 			}
-			blackboxRunner.StartWithConfig(blackboxConfig, 1)
-			Write(logFile, "hello\n", true, true)
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 2)
+			defer blackboxRunner.Stop()
 
+			Write(logFile, "hello\n", true, false)
 			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
 
-			blackboxRunner.Stop()
+			Write(anotherLogFile, "hello from the other side\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("hello from the other side"))
+
+			Expect(server.Accepted.Load()).To(BeEquivalentTo(1))
 		})
 	})
 
-	Context("When the server uses bad tls", func() {
-		var address string
-		var buffer *gbytes.Buffer
-		var tlsserver TLSSyslogServer
-		var blackboxRunner *BlackboxRunner
+	Context("when writes are batched", func() {
+		var (
+			address string
+			buffer  *gbytes.Buffer
+			config  blackbox.Config
+		)
 
 		BeforeEach(func() {
 			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
 			buffer = gbytes.NewBuffer()
-			tlsserver = TLSSyslogServer{
-				Addr:               address,
-				Buffer:             buffer,
-				CertPrefixOverride: "./fixtures/server-bad",
-			}
-			err := tlsserver.Run()
-			Expect(err).ToNot(HaveOccurred())
-			blackboxRunner = NewBlackboxRunner(blackboxPath)
-		})
 
-		AfterEach(func() {
-			tlsserver.Stop()
+			config = blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:     "tcp",
+						Address:       address,
+						FlushInterval: time.Hour,
+					},
+					SourceDir: logDir,
+				},
+			}
+		})
+
+		It("sends the pending messages once the batch is full", func() {
+			config.Syslog.Destination.BatchSize = 512
+
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			Write(logFile, "first\n", true, false)
+			Consistently(buffer, "500ms").ShouldNot(gbytes.Say("first"))
+
+			for i := range 10 {
+				Write(logFile, fmt.Sprintf("filler %d\n", i), true, false)
+			}
+			Eventually(buffer, "5s").Should(gbytes.Say("first"))
+		})
+
+		It("sends the pending messages when stopped", func() {
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "hello\n", true, false)
+			Consistently(buffer, "2s").ShouldNot(gbytes.Say("hello"))
+
+			blackboxRunner.Interrupt()
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+		})
+	})
+
+	Context("when non-transparent framing is configured", func() {
+		var (
+			buffer         *gbytes.Buffer
+			serverProcess  ifrit.Process
+			blackboxRunner *BlackboxRunner
+			config         blackbox.Config
+		)
+
+		BeforeEach(func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+
+			config = blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+						Framing:   syslog.FramingNonTransparent,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			blackboxRunner.Stop()
+			ginkgomon.Interrupt(serverProcess)
+		})
+
+		It("ends every message with a newline instead of counting its octets", func() {
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "hello\n", false, false)
+			Write(logFile, "world\n", true, false)
+
+			Eventually(buffer, "5s").Should(gbytes.Say(`^<14>1 [^\n]* - - hello\n<14>1 [^\n]* - - world\n`))
+		})
+
+		It("escapes newlines inside messages", func() {
+			config.Syslog.Multiline = []blackbox.MultilineConfig{
+				{Tag: tagName, ContinuationPattern: `^\s`},
+			}
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "panic: oops\n", false, false)
+			Write(logFile, "\tat main.go:12\n", false, false)
+			Write(logFile, "done\n", true, false)
+
+			Eventually(buffer, "5s").Should(gbytes.Say(`- - panic: oops#012\tat main.go:12\n`))
+		})
+	})
+
+	Context("when the rfc3164 format is configured", func() {
+		It("sends BSD syslog messages with the tag cut to 32 characters", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer := gbytes.NewBuffer()
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			longTag := "a-service-with-a-rather-long-name-indeed"
+			Expect(os.Mkdir(filepath.Join(logDir, longTag), os.ModePerm)).To(Succeed())
+			longTagFile, err := os.OpenFile(
+				filepath.Join(logDir, longTag, "tail.log"),
+				os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+				os.ModePerm,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer longTagFile.Close()
+
+			config := blackbox.Config{
+				Hostname: "bsd-host",
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+						Format:    syslog.FormatRFC3164,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 2)
+			defer blackboxRunner.Stop()
+
+			Write(logFile, "hello\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say(`\d+ <14>[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} bsd-host test-tag\[rs2\]: hello`))
+
+			Write(longTagFile, "hello from afar\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say(`bsd-host a-service-with-a-rather-long-nam\[rs2\]: hello from afar`))
+		})
+	})
+
+	Context("when a local transport is configured", func() {
+		It("writes JSON lines to stdout", func() {
+			config := blackbox.Config{
+				Hostname:         "json-host",
+				StructuredDataID: "StructuredData@1",
+				StructuredDataMap: map[string]string{
+					"env": "test",
+				},
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: syslog.TransportStdout,
+					},
+					SourceDir: logDir,
+				},
+			}
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Kill()
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, "hello \"world\"\n", true, false)
+
+			Eventually(session.Out, "5s").Should(gbytes.Say(`\n`))
+			var line map[string]any
+			Expect(json.Unmarshal(session.Out.Contents(), &line)).To(Succeed())
+			Expect(line).To(HaveKeyWithValue("hostname", "json-host"))
+			Expect(line).To(HaveKeyWithValue("tag", tagName))
+			Expect(line).To(HaveKeyWithValue("path", logFile.Name()))
+			Expect(line).To(HaveKeyWithValue("severity", "info"))
+			Expect(line).To(HaveKeyWithValue("message", `hello "world"`))
+			Expect(line).To(HaveKeyWithValue("structured_data", map[string]any{
+				"StructuredData@1": map[string]any{"env": "test"},
+			}))
+			Expect(line).To(HaveKey("timestamp"))
+		})
+
+		It("writes JSON lines to a file and rotates it", func() {
+			sinkDir, err := os.MkdirTemp("", "blackbox-sink")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(sinkDir)
+			sinkPath := filepath.Join(sinkDir, "blackbox.jsonl")
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: syslog.TransportFile,
+						File: syslog.FileConfig{
+							Path:       sinkPath,
+							MaxSize:    512,
+							MaxBackups: 2,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			for i := range 20 {
+				Write(logFile, fmt.Sprintf("line %d\n", i), true, false)
+			}
+
+			Eventually(func() ([]byte, error) {
+				return os.ReadFile(sinkPath)
+			}, "5s").Should(ContainSubstring(`"message":"line 19"`))
+
+			Expect(sinkPath + ".1").To(BeAnExistingFile())
+			Expect(sinkPath + ".2").To(BeAnExistingFile())
+			Expect(sinkPath + ".3").NotTo(BeAnExistingFile())
+
+			for _, path := range []string{sinkPath, sinkPath + ".1", sinkPath + ".2"} {
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeNumerically("<=", 512))
+			}
+		})
+	})
+
+	Context("when the http transport is configured", func() {
+		type request struct {
+			header http.Header
+			body   []byte
+		}
+
+		var (
+			requests  chan request
+			responses chan int
+			handler   http.HandlerFunc
+		)
+
+		BeforeEach(func() {
+			requests = make(chan request, 10)
+			responses = make(chan int, 10)
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				var body io.Reader = r.Body
+				if r.Header.Get("Content-Encoding") == "gzip" {
+					gzipReader, err := gzip.NewReader(r.Body)
+					Expect(err).NotTo(HaveOccurred())
+					body = gzipReader
+				}
+				contents, err := io.ReadAll(body)
+				Expect(err).NotTo(HaveOccurred())
+				requests <- request{header: r.Header, body: contents}
+
+				select {
+				case status := <-responses:
+					w.WriteHeader(status)
+				default:
+				}
+			}
+		})
+
+		It("posts batches of JSON lines and retries when the endpoint is unavailable", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			tokenFile, err := os.CreateTemp("", "bearer-token")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(tokenFile.Name())
+			Write(tokenFile, "s3cr3t\n", true, true)
+
+			config := blackbox.Config{
+				Hostname: "http-host",
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:     syslog.TransportHTTP,
+						Address:       server.URL + "/ingest",
+						FlushInterval: 200 * time.Millisecond,
+						HTTP: syslog.HTTPConfig{
+							Headers:         map[string]string{"X-Source": "blackbox"},
+							BearerTokenFile: tokenFile.Name(),
+							Gzip:            true,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			responses <- http.StatusServiceUnavailable
+
+			Write(logFile, "hello\n", false, false)
+			Write(logFile, "world\n", true, false)
+
+			var failed, retried request
+			Eventually(requests, "5s").Should(Receive(&failed))
+			Eventually(requests, "5s").Should(Receive(&retried))
+			Expect(retried.body).To(Equal(failed.body))
+
+			Expect(retried.header.Get("Authorization")).To(Equal("Bearer s3cr3t"))
+			Expect(retried.header.Get("X-Source")).To(Equal("blackbox"))
+			Expect(retried.header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+			lines := strings.Split(strings.TrimSuffix(string(retried.body), "\n"), "\n")
+			Expect(lines).To(HaveLen(2))
+			var line map[string]any
+			Expect(json.Unmarshal([]byte(lines[1]), &line)).To(Succeed())
+			Expect(line).To(HaveKeyWithValue("message", "world"))
+			Expect(line).To(HaveKeyWithValue("hostname", "http-host"))
+			Expect(line).To(HaveKeyWithValue("tag", tagName))
+		})
+
+		It("posts JSON arrays over https", func() {
+			cert, err := tls.LoadX509KeyPair("fixtures/server.crt", "fixtures/server.key")
+			Expect(err).NotTo(HaveOccurred())
+			server := httptest.NewUnstartedServer(handler)
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint:gosec
+			server.StartTLS()
+			defer server.Close()
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:     syslog.TransportHTTP,
+						Address:       server.URL,
+						CA:            "./fixtures/ca.crt",
+						FlushInterval: 200 * time.Millisecond,
+						HTTP: syslog.HTTPConfig{
+							Body: syslog.HTTPBodyJSONArray,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			Write(logFile, "hello\n", true, false)
+
+			var received request
+			Eventually(requests, "5s").Should(Receive(&received))
+			Expect(received.header.Get("Content-Type")).To(Equal("application/json"))
+
+			var lines []map[string]any
+			Expect(json.Unmarshal(received.body, &lines)).To(Succeed())
+			Expect(lines).To(HaveLen(1))
+			Expect(lines[0]).To(HaveKeyWithValue("message", "hello"))
+		})
+	})
+
+	Context("when a line is larger than the max message size", func() {
+		var (
+			buffer         *gbytes.Buffer
+			serverProcess  ifrit.Process
+			blackboxRunner *BlackboxRunner
+			config         blackbox.Config
+		)
+
+		BeforeEach(func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+
+			config = blackbox.Config{
+				MaxMessageSize: 301,
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			blackboxRunner.Stop()
+			ginkgomon.Interrupt(serverProcess)
+		})
+
+		It("truncates it on a rune boundary with a marker", func() {
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, strings.Repeat("é", 500)+"\n", true, false)
+
+			var messages []string
+			Eventually(func() []string {
+				messages = OctetCountedMessages(buffer.Contents())
+				return messages
+			}, "5s").Should(HaveLen(1))
+			Expect(len(messages[0])).To(BeNumerically("<=", 301))
+			Expect(messages[0]).To(HaveSuffix("é[truncated]"))
+			Expect(utf8.ValidString(messages[0])).To(BeTrue())
+		})
+
+		It("splits it into linked parts when configured to", func() {
+			config.Syslog.Destination.OversizePolicy = syslog.OversizePolicySplit
+			blackboxRunner.StartWithConfig(config, 1)
+
+			line := strings.Repeat("0123456789", 100)
+			Write(logFile, line+"\n", true, false)
+
+			partPattern := regexp.MustCompile(`\[split@47450 id="([0-9a-f]+)" part="(\d+)" total="(\d+)"\] (.*)$`)
+			var messages []string
+			Eventually(func() int {
+				messages = OctetCountedMessages(buffer.Contents())
+				if len(messages) == 0 {
+					return -1
+				}
+				match := partPattern.FindStringSubmatch(messages[0])
+				if match == nil {
+					return -1
+				}
+				total, _ := strconv.Atoi(match[3])
+				return total - len(messages)
+			}, "5s").Should(BeZero())
+			Expect(len(messages)).To(BeNumerically(">", 1))
+
+			var ids []string
+			var reassembled string
+			for i, message := range messages {
+				Expect(len(message)).To(BeNumerically("<=", 301))
+				match := partPattern.FindStringSubmatch(message)
+				Expect(match).NotTo(BeNil(), message)
+				Expect(match[2]).To(Equal(strconv.Itoa(i + 1)))
+				ids = append(ids, match[1])
+				reassembled += match[4]
+			}
+			Expect(ids).To(HaveEach(ids[0]))
+			Expect(reassembled).To(Equal(line))
+		})
+
+		It("drops it and counts the drops when configured to", func() {
+			config.Syslog.Destination.OversizePolicy = syslog.OversizePolicyDrop
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Kill()
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, strings.Repeat("a", 1000)+"\n", false, false)
+			Write(logFile, "small enough\n", true, false)
+
+			Eventually(buffer, "5s").Should(gbytes.Say("small enough"))
+			Expect(OctetCountedMessages(buffer.Contents())).To(HaveLen(1))
+			Eventually(session.Err).Should(gbytes.Say("Dropped a message of \\d+ bytes .* 1 dropped so far"))
+		})
+	})
+
+	Context("when a metrics address is configured", func() {
+		var metricsAddress string
+
+		BeforeEach(func() {
+			metricsAddress = fmt.Sprintf("127.0.0.1:%d", 9290+GinkgoParallelProcess())
+		})
+
+		getMetrics := func() (string, error) {
+			response, err := http.Get("http://" + metricsAddress + "/metrics")
+			if err != nil {
+				return "", err
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			return string(body), err
+		}
+
+		It("serves metrics about files and destinations", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+
+			buffer := gbytes.NewBuffer()
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			config := blackbox.Config{
+				MetricsAddress: metricsAddress,
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			Write(logFile, "hello\n", false, false)
+			Write(logFile, "world\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("world"))
+
+			Eventually(getMetrics, "5s").Should(SatisfyAll(
+				ContainSubstring(fmt.Sprintf(`blackbox_lines_read_total{tag="%s",path="%s"} 2`, tagName, logFile.Name())),
+				ContainSubstring(fmt.Sprintf(`blackbox_messages_sent_total{destination="%s"} 2`, address)),
+				ContainSubstring(fmt.Sprintf(`blackbox_connection_attempts_total{destination="%s"} 1`, address)),
+				ContainSubstring(fmt.Sprintf("# TYPE blackbox_watched_files gauge\nblackbox_watched_files{source=\"%s\"} 1\n", logDir)),
+			))
+		})
+
+		It("stops serving the metrics of files that are no longer tailed", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+
+			buffer := gbytes.NewBuffer()
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			config := blackbox.Config{
+				MetricsAddress: metricsAddress,
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			}
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				session.Kill()
+				session.Wait()
+			}()
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, "hello\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+
+			series := fmt.Sprintf(`blackbox_lines_read_total{tag="%s",path="%s"}`, tagName, logFile.Name())
+			Eventually(getMetrics, "5s").Should(ContainSubstring(series))
+
+			config.Syslog.ExcludeFilePattern = logfileName
+			contents, err := yaml.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+			Expect(session.Command.Process.Signal(syscall.SIGHUP)).To(Succeed())
+			Eventually(session.Err, "5s").Should(gbytes.Say("Stopping to tail file: .*" + logfileName))
+
+			Eventually(getMetrics, "5s").ShouldNot(ContainSubstring(series))
+		})
+
+		It("counts the messages dropped for a destination", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			}))
+			defer server.Close()
+
+			config := blackbox.Config{
+				MetricsAddress: metricsAddress,
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:     syslog.TransportHTTP,
+						Address:       server.URL,
+						FlushInterval: 100 * time.Millisecond,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			Write(logFile, "hello\n", false, false)
+			Write(logFile, "world\n", true, false)
+
+			Eventually(getMetrics, "5s").Should(ContainSubstring(fmt.Sprintf(`blackbox_dropped_messages_total{destination="%s"} 2`, server.URL)))
+		})
+	})
+
+	Context("when health checks are served", func() {
+		It("reports readiness and the health of each destination", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			metricsAddress := fmt.Sprintf("127.0.0.1:%d", 9290+GinkgoParallelProcess())
+
+			buffer := gbytes.NewBuffer()
+			serverProcess := ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+
+			config := blackbox.Config{
+				MetricsAddress:    metricsAddress,
+				HealthCheckWindow: time.Second,
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner := NewBlackboxRunner(blackboxPath)
+			blackboxRunner.StartWithConfig(config, 1)
+			defer blackboxRunner.Stop()
+
+			type status struct {
+				Status       string
+				Destinations []map[string]any
+			}
+			getStatus := func(path string) func() (int, status, error) {
+				return func() (int, status, error) {
+					var s status
+					response, err := http.Get("http://" + metricsAddress + path)
+					if err != nil {
+						return 0, s, err
+					}
+					defer response.Body.Close()
+					err = json.NewDecoder(response.Body).Decode(&s)
+					return response.StatusCode, s, err
+				}
+			}
+
+			Eventually(func() (int, error) {
+				code, _, err := getStatus("/readyz")()
+				return code, err
+			}, "10s").Should(Equal(http.StatusOK))
+
+			Write(logFile, "hello\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+
+			code, healthy, err := getStatus("/healthz")()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(healthy.Status).To(Equal("ok"))
+			Expect(healthy.Destinations).To(ConsistOf(SatisfyAll(
+				HaveKeyWithValue("destination", address),
+				HaveKeyWithValue("connections", BeEquivalentTo(1)),
+				HaveKey("last_success"),
+			)))
+
+			ginkgomon.Interrupt(serverProcess)
+			Write(logFile, "hello?\n", true, false)
+			Write(logFile, "anybody there?\n", true, false)
+
+			Eventually(func() (int, error) {
+				code, _, err := getStatus("/healthz")()
+				return code, err
+			}, "10s").Should(Equal(http.StatusServiceUnavailable))
+			_, unhealthy, err := getStatus("/healthz")()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unhealthy.Status).To(Equal("unhealthy"))
+			Expect(unhealthy.Destinations[0]).To(HaveKeyWithValue("last_error", ContainSubstring("connection refused")))
+
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			defer ginkgomon.Interrupt(serverProcess)
+
+			Eventually(func() (int, error) {
+				code, _, err := getStatus("/healthz")()
+				return code, err
+			}, "10s").Should(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when a spool is configured", func() {
+		var (
+			serverProcess ifrit.Process
+			spoolDir      string
+		)
+
+		BeforeEach(func() {
+			var err error
+			spoolDir, err = os.MkdirTemp("", "blackbox-spool")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			ginkgomon.Interrupt(serverProcess)
+			os.RemoveAll(spoolDir)
+		})
+
+		It("replays messages spooled while the server was down after a restart", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+						Spool: syslog.SpoolConfig{
+							Dir: spoolDir,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, "first while down\n", false, false)
+			Write(logFile, "second while down\n", true, false)
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Error connecting"))
+			Eventually(func() string {
+				segments, _ := filepath.Glob(filepath.Join(spoolDir, "*.spool"))
+				var contents string
+				for _, segment := range segments {
+					data, _ := os.ReadFile(segment)
+					contents += string(data)
+				}
+				return contents
+			}, "5s").Should(ContainSubstring("second while down"))
+
+			session.Kill()
+			Eventually(session, "5s").Should(gexec.Exit())
+
+			buffer := gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			})
+
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				session.Kill()
+				session.Wait()
+			}()
+
+			Eventually(buffer, "10s").Should(gbytes.Say("first while down"))
+			Eventually(buffer, "5s").Should(gbytes.Say("second while down"))
+
+			Write(logFile, "back up\n", true, true)
+			Eventually(buffer, "10s").Should(gbytes.Say("back up"))
+		})
+
+		It("does not send delivered messages again after a restart", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer := gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			})
+
+			configPath := CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+						Spool: syslog.SpoolConfig{
+							Dir: spoolDir,
+						},
+					},
+					SourceDir: logDir,
+				},
+			})
+			defer os.Remove(configPath)
+
+			start := func() *gexec.Session {
+				session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+				return session
+			}
+
+			session := start()
+			Write(logFile, "delivered before the restart\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("delivered before the restart"))
+			session.Interrupt()
+			Eventually(session, "5s").Should(gexec.Exit())
+
+			session = start()
+			Write(logFile, "delivered before the kill\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("delivered before the kill"))
+			// once how far replay got has been saved
+			time.Sleep(2 * time.Second)
+			session.Kill()
+			Eventually(session, "5s").Should(gexec.Exit())
+
+			session = start()
+			defer func() {
+				session.Kill()
+				session.Wait()
+			}()
+			Write(logFile, "delivered after the restarts\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("delivered after the restarts"))
+
+			Consistently(buffer.Contents, "2s").Should(And(
+				WithTransform(func(contents []byte) int {
+					return strings.Count(string(contents), "delivered before the restart")
+				}, Equal(1)),
+				WithTransform(func(contents []byte) int {
+					return strings.Count(string(contents), "delivered before the kill")
+				}, Equal(1)),
+			))
+		})
+
+		It("sends messages spooled while the server was down once after a reload", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+
+			config := blackbox.Config{
+				Hostname: "before-reload",
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+						Spool: syslog.SpoolConfig{
+							Dir: spoolDir,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				session.Kill()
+				session.Wait()
+			}()
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, "spooled before the reload\n", true, false)
+			Eventually(session.Err, "5s").Should(gbytes.Say("Error connecting"))
+
+			// a changed hostname makes the reload replace the destinations
+			config.Hostname = "after-reload"
+			contents, err := yaml.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+			Expect(session.Command.Process.Signal(syscall.SIGHUP)).To(Succeed())
+			Eventually(session.Err, "5s").Should(gbytes.Say("Reloaded config file"))
+
+			buffer := gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			})
+
+			Eventually(buffer, "10s").Should(gbytes.Say("spooled before the reload"))
+			Consistently(func() int {
+				return strings.Count(string(buffer.Contents()), "spooled before the reload")
+			}, "3s").Should(Equal(1))
+		})
+
+		It("keeps running while the server is down for longer than max retries and sends the spooled messages in order", func() {
+			address := fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer := gbytes.NewBuffer()
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			})
+
+			configPath := CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:  "tcp",
+						Address:    address,
+						MaxRetries: 1,
+						Spool: syslog.SpoolConfig{
+							Dir: spoolDir,
+						},
+					},
+					SourceDir: logDir,
+				},
+			})
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				session.Kill()
+				session.Wait()
+			}()
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+
+			Write(logFile, "before the outage\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("before the outage"))
+
+			ginkgomon.Interrupt(serverProcess)
+			for i := range 5 {
+				Write(logFile, fmt.Sprintf("during the outage %d\n", i), true, false)
+			}
+			Eventually(session.Err, "10s").Should(gbytes.Say("destination is unavailable"))
+			Consistently(session, "3s").ShouldNot(gexec.Exit())
+
+			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			})
+			for i := range 5 {
+				Eventually(buffer, "30s").Should(gbytes.Say(fmt.Sprintf("during the outage %d", i)))
+			}
+		})
+	})
+
+	Context("when multiple destinations are configured", func() {
+		var (
+			firstAddress, secondAddress string
+			firstBuffer, secondBuffer   *gbytes.Buffer
+			firstServer, secondServer   ifrit.Process
+			blackboxRunner              *BlackboxRunner
+		)
+
+		BeforeEach(func() {
+			firstAddress = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			secondAddress = fmt.Sprintf("127.0.0.1:%d", 9190+GinkgoParallelProcess())
+			firstBuffer = gbytes.NewBuffer()
+			secondBuffer = gbytes.NewBuffer()
+			firstServer = nil
+			secondServer = nil
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			blackboxRunner.Stop()
+			ginkgomon.Interrupt(firstServer)
+			ginkgomon.Interrupt(secondServer)
+		})
+
+		It("sends every message to all destinations in fan-out mode", func() {
+			firstServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: firstAddress, Buffer: firstBuffer})
+			secondServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: secondAddress, Buffer: secondBuffer})
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destinations: []blackbox.DestinationGroup{
+						{
+							Mode: "fan_out",
+							Destinations: []syslog.Drain{
+								{Transport: "tcp", Address: firstAddress},
+								{Transport: "tcp", Address: secondAddress},
+							},
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "hello\n", true, true)
+
+			Eventually(firstBuffer, "5s").Should(gbytes.Say("hello"))
+			Eventually(secondBuffer, "5s").Should(gbytes.Say("hello"))
+		})
+
+		It("sends messages to a backup while the primary is down in failover mode", func() {
+			secondServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: secondAddress, Buffer: secondBuffer})
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destinations: []blackbox.DestinationGroup{
+						{
+							Mode: "failover",
+							Destinations: []syslog.Drain{
+								{Transport: "tcp", Address: firstAddress},
+								{Transport: "tcp", Address: secondAddress},
+							},
+							PrimaryCheckInterval: time.Second,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "to the backup\n", true, false)
+			Eventually(secondBuffer, "5s").Should(gbytes.Say("to the backup"))
+
+			firstServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: firstAddress, Buffer: firstBuffer})
+			time.Sleep(2 * time.Second)
+
+			Write(logFile, "back to the primary\n", true, true)
+			Eventually(firstBuffer, "5s").Should(gbytes.Say("back to the primary"))
+			Consistently(secondBuffer).ShouldNot(gbytes.Say("back to the primary"))
+		})
+
+		It("fails over from an http primary that returns server errors and back", func() {
+			secondServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: secondAddress, Buffer: secondBuffer})
+
+			var down atomic.Bool
+			down.Store(true)
+			posted := gbytes.NewBuffer()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if down.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				io.Copy(posted, r.Body) //nolint:errcheck
+			}))
+			defer server.Close()
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destinations: []blackbox.DestinationGroup{
+						{
+							Mode: "failover",
+							Destinations: []syslog.Drain{
+								{Transport: syslog.TransportHTTP, Address: server.URL, FlushInterval: 100 * time.Millisecond},
+								{Transport: "tcp", Address: secondAddress},
+							},
+							PrimaryCheckInterval: time.Second,
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(config, 1)
+
+			Write(logFile, "to the backup\n", true, false)
+			Eventually(secondBuffer, "5s").Should(gbytes.Say("to the backup"))
+
+			down.Store(false)
+			time.Sleep(2 * time.Second)
+
+			Write(logFile, "back to the primary\n", true, true)
+			Eventually(posted, "5s").Should(gbytes.Say("back to the primary"))
+			Consistently(secondBuffer).ShouldNot(gbytes.Say("back to the primary"))
+			Expect(posted).NotTo(gbytes.Say("to the backup"))
+		})
+	})
+
+	Context("when several sources are configured", func() {
+		var (
+			appDir                      string
+			firstAddress, secondAddress string
+			firstBuffer, secondBuffer   *gbytes.Buffer
+			firstServer, secondServer   ifrit.Process
+			blackboxRunner              *BlackboxRunner
+		)
+
+		BeforeEach(func() {
+			var err error
+			appDir, err = os.MkdirTemp("", "app-logs")
+			Expect(err).NotTo(HaveOccurred())
+
+			firstAddress = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			secondAddress = fmt.Sprintf("127.0.0.1:%d", 9190+GinkgoParallelProcess())
+			firstBuffer = gbytes.NewBuffer()
+			secondBuffer = gbytes.NewBuffer()
+			firstServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: firstAddress, Buffer: firstBuffer})
+			secondServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: secondAddress, Buffer: secondBuffer})
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			blackboxRunner.Stop()
+			ginkgomon.Interrupt(firstServer)
+			ginkgomon.Interrupt(secondServer)
+			os.RemoveAll(appDir)
+		})
+
+		It("tails each source with its own settings and sends it to its destination", func() {
+			appFile, err := os.Create(filepath.Join(appDir, "app.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			defer appFile.Close()
+			ignoredFile, err := os.Create(filepath.Join(appDir, "ignored.log"))
+			Expect(err).NotTo(HaveOccurred())
+			defer ignoredFile.Close()
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destinations: []blackbox.DestinationGroup{
+						{
+							Name:         "system",
+							Destinations: []syslog.Drain{{Transport: "tcp", Address: firstAddress}},
+						},
+						{
+							Name:         "apps",
+							Destinations: []syslog.Drain{{Transport: "tcp", Address: secondAddress}},
+						},
+					},
+					Sources: []blackbox.SourceConfig{
+						{
+							Dir:         logDir,
+							Destination: "system",
+						},
+						{
+							Name:                "app",
+							Dir:                 appDir,
+							IncludeFilePatterns: []string{"*.txt"},
+							TagStrategy:         blackbox.TagStrategyFixed,
+							Tag:                 "my-app",
+							StructuredDataID:    "app@47450",
+							StructuredDataMap:   map[string]string{"team": "payments"},
+							Destination:         "apps",
+						},
+					},
+				},
+			}
+			blackboxRunner.StartWithConfig(config, 1)
+			time.Sleep(2 * time.Second)
+
+			Write(logFile, "from the system\n", true, false)
+			Write(appFile, "from the app\n", true, false)
+			Write(ignoredFile, "not included\n", true, false)
+
+			Eventually(firstBuffer, "5s").Should(gbytes.Say(tagName + ` rs2 - - from the system`))
+			Eventually(secondBuffer, "5s").Should(gbytes.Say(`my-app rs2 - \[app@47450 team="payments"\] from the app`))
+			Consistently(firstBuffer, "2s").ShouldNot(gbytes.Say("from the app|not included"))
+			Expect(secondBuffer).NotTo(gbytes.Say("from the system|not included"))
+		})
+	})
+
+	Context("when file patterns are configured", func() {
+		var (
+			address        string
+			buffer         *gbytes.Buffer
+			server         ifrit.Process
+			blackboxRunner *BlackboxRunner
+		)
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			server = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			blackboxRunner.Stop()
+			ginkgomon.Interrupt(server)
+		})
+
+		createFile := func(path string) *os.File {
+			path = filepath.Join(logDir, path)
+			Expect(os.MkdirAll(filepath.Dir(path), os.ModePerm)).To(Succeed())
+			file, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(file.Close)
+			return file
+		}
+
+		It("tails the files matching the include patterns but none of the exclude patterns", func() {
+			outFile := createFile("app/server.out")
+			currentFile := createFile("worker/current")
+			accessFile := createFile("nginx/access.log")
+			errorFile := createFile("nginx/error.log")
+			debugFile := createFile("app/debug/trace.out")
+			skippedFile := createFile("worker/skipped.out")
+
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir:           logDir,
+					IncludeFilePatterns: []string{"**/*.out", "**/current", "nginx/access*.log", "!**/debug/**"},
+					ExcludeFilePatterns: []string{"worker/skipped.*"},
+				},
+			}
+			blackboxRunner.StartWithConfig(config, 3)
+			time.Sleep(2 * time.Second)
+
+			Write(outFile, "from the out file\n", true, false)
+			Write(currentFile, "from the extensionless file\n", true, false)
+			Write(accessFile, "from the access log\n", true, false)
+			Write(errorFile, "from the error log\n", true, false)
+			Write(debugFile, "from the debug dir\n", true, false)
+			Write(skippedFile, "from the skipped file\n", true, false)
+			Write(logFile, "from the default pattern\n", true, false)
+
+			// the files are tailed concurrently, so their lines arrive in any order
+			contents := func() string { return string(buffer.Contents()) }
+			Eventually(contents, "5s").Should(And(
+				ContainSubstring("app rs2 - - from the out file"),
+				ContainSubstring("worker rs2 - - from the extensionless file"),
+				ContainSubstring("nginx rs2 - - from the access log"),
+			))
+			Consistently(contents, "2s").ShouldNot(MatchRegexp("from the error log|from the debug dir|from the skipped file|from the default pattern"))
+		})
+	})
+
+	Context("when files are discovered through notifications", func() {
+		var (
+			address    string
+			buffer     *gbytes.Buffer
+			server     ifrit.Process
+			configPath string
+			session    *gexec.Session
+		)
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			server = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+
+			configPath = CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+					Discovery: blackbox.DiscoveryNotify,
+				},
+			})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			os.Remove(configPath)
+			ginkgomon.Interrupt(server)
+		})
+
+		It("tails files in new directories without waiting for a scan", func() {
+			Expect(os.MkdirAll(filepath.Join(logDir, "new-tag", "nested"), os.ModePerm)).To(Succeed())
+			newFile, err := os.Create(filepath.Join(logDir, "new-tag", "nested", "new.log"))
+			Expect(err).NotTo(HaveOccurred())
+			defer newFile.Close()
+
+			// well within the poll interval of the scans
+			Eventually(session.Err, "1s").Should(gbytes.Say("Starting to tail file: .*new.log"))
+			time.Sleep(time.Second)
+
+			Write(newFile, "from the new file\n", true, false)
+			Write(logFile, "from the existing file\n", true, false)
+
+			contents := func() string { return string(buffer.Contents()) }
+			Eventually(contents, "2s").Should(And(
+				ContainSubstring("new-tag/nested rs2 - - from the new file"),
+				ContainSubstring(tagName+" rs2 - - from the existing file"),
+			))
+		})
+
+		It("reads tailed files every second again once reloaded to poll", func() {
+			Write(logFile, "before reloading\n", true, false)
+			Eventually(buffer, "2s").Should(gbytes.Say("before reloading"))
+
+			contents, err := yaml.Marshal(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+					Discovery: blackbox.DiscoveryPoll,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+			Expect(session.Command.Process.Signal(syscall.SIGHUP)).To(Succeed())
+			Eventually(session.Err, "5s").Should(gbytes.Say("Reloaded config file"))
+
+			// without notifications, well within the poll interval of the scans
+			for i := 0; i < 3; i++ {
+				Write(logFile, fmt.Sprintf("after reloading %d\n", i), true, false)
+				Eventually(buffer, "2s").Should(gbytes.Say(fmt.Sprintf("after reloading %d", i)))
+			}
+		})
+	})
+
+	Context("when a start position is configured", func() {
+		var (
+			address    string
+			buffer     *gbytes.Buffer
+			server     ifrit.Process
+			configPath string
+			session    *gexec.Session
+		)
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			server = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+
+			Write(logFile, "already present\n", true, false)
+		})
+
+		start := func(startPosition string) {
+			configPath = CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir:     logDir,
+					StartPosition: startPosition,
+				},
+			})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+		}
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			os.Remove(configPath)
+			ginkgomon.Interrupt(server)
+		})
+
+		It("reads existing files from their beginning", func() {
+			start(blackbox.StartPositionBeginning)
+
+			Eventually(buffer, "5s").Should(gbytes.Say(tagName + " rs2 - - already present"))
+		})
+
+		It("reads only the files found after the first scan from their beginning", func() {
+			start(blackbox.StartPositionBeginningForNewFiles)
+
+			Expect(os.MkdirAll(filepath.Join(logDir, "new-tag"), os.ModePerm)).To(Succeed())
+			newFile, err := os.Create(filepath.Join(logDir, "new-tag", "new.log"))
+			Expect(err).NotTo(HaveOccurred())
+			defer newFile.Close()
+			// before the next scan finds the file
+			Write(newFile, "written before it was found\n", true, false)
+
+			Eventually(buffer, "10s").Should(gbytes.Say("new-tag rs2 - - written before it was found"))
+
+			Write(logFile, "hello\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say(tagName + " rs2 - - hello"))
+			Expect(string(buffer.Contents())).NotTo(ContainSubstring("already present"))
+		})
+	})
+
+	Context("when files are rotated", func() {
+		var (
+			address    string
+			buffer     *gbytes.Buffer
+			server     ifrit.Process
+			configPath string
+			session    *gexec.Session
+			logPath    string
+		)
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			server = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+			logPath = filepath.Join(logDir, tagName, logfileName)
+
+			// writers append, as copytruncate needs them to
+			logFile.Close()
+			var err error
+			logFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			configPath = CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			})
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			os.Remove(configPath)
+			ginkgomon.Interrupt(server)
+		})
+
+		// create rotates the log the way logrotate's create strategy does,
+		// leaving the writer with the old file until it reopens its log
+		create := func() *os.File {
+			Expect(os.Rename(logPath, logPath+".1")).To(Succeed())
+			newFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+			return newFile
+		}
+
+		It("reads the lines written to the old file after a rename before switching to the new one", func() {
+			Write(logFile, "before the rotation\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("before the rotation"))
+
+			newFile := create()
+			defer newFile.Close()
+			Write(newFile, "to the new file\n", true, false)
+			Write(logFile, "to the old file after the rotation\n", true, true)
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("File .*" + logfileName + " was moved or removed"))
+			Eventually(buffer, "5s").Should(gbytes.Say("to the old file after the rotation"))
+			Eventually(session.Err, "10s").Should(gbytes.Say("Switching to the new file at .*" + logfileName))
+			Eventually(buffer, "5s").Should(gbytes.Say("to the new file"))
+		})
+
+		It("reads the lines it missed from the copy after a copytruncate", func() {
+			Write(logFile, "before the rotation\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("before the rotation"))
+
+			Write(logFile, "just before the copy\n", true, false)
+			contents, err := os.ReadFile(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(logPath+".1", contents, 0600)).To(Succeed())
+			Expect(os.Truncate(logPath, 0)).To(Succeed())
+			Write(logFile, "after the truncation\n", true, false)
+
+			Eventually(buffer, "5s").Should(gbytes.Say("just before the copy"))
+			Eventually(buffer, "5s").Should(gbytes.Say("after the truncation"))
+			Consistently(buffer, "2s").ShouldNot(gbytes.Say("before the rotation|just before the copy"))
+		})
+
+		It("reads every line once over rotations with delaycompress", func() {
+			Write(logFile, "first\n", true, true)
+
+			// the first rotation leaves the rotated file uncompressed
+			secondFile := create()
+			Write(secondFile, "second\n", true, false)
+			Eventually(session.Err, "10s").Should(gbytes.Say("Switching to the new file"))
+
+			// the next one compresses it and rotates the current file
+			compressed, err := os.Create(logPath + ".2.gz")
+			Expect(err).NotTo(HaveOccurred())
+			writer := gzip.NewWriter(compressed)
+			rotated, err := os.ReadFile(logPath + ".1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = writer.Write(rotated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+			Expect(compressed.Close()).To(Succeed())
+			Expect(os.Remove(logPath + ".1")).To(Succeed())
+
+			thirdFile := create()
+			defer thirdFile.Close()
+			Write(secondFile, "still second\n", true, true)
+			Write(thirdFile, "third\n", true, false)
+			Eventually(session.Err, "10s").Should(gbytes.Say("Switching to the new file"))
+
+			lines := func() []string {
+				var lines []string
+				for _, message := range OctetCountedMessages(buffer.Contents()) {
+					_, line, _ := strings.Cut(message, " - - ")
+					lines = append(lines, line)
+				}
+				return lines
+			}
+			Eventually(lines, "5s").Should(Equal([]string{"first", "second", "still second", "third"}))
+			Consistently(lines, "2s").Should(HaveLen(4))
+		})
+	})
+
+	Context("when files are removed or idle", func() {
+		var (
+			address    string
+			buffer     *gbytes.Buffer
+			server     ifrit.Process
+			configPath string
+			session    *gexec.Session
+		)
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			server = ginkgomon.Invoke(&TcpSyslogServer{Addr: address, Buffer: buffer})
+		})
+
+		start := func(idleTimeout time.Duration) {
+			configPath = CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir:   logDir,
+					IdleTimeout: idleTimeout,
+				},
+			})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+			time.Sleep(2 * time.Second)
+		}
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			os.Remove(configPath)
+			ginkgomon.Interrupt(server)
+		})
+
+		It("stops tailing a removed file and tails it from its beginning once it reappears", func() {
+			start(0)
+			Write(logFile, "before the removal\n", true, true)
+			Eventually(buffer, "5s").Should(gbytes.Say("before the removal"))
+			Expect(os.Remove(logFile.Name())).To(Succeed())
+
+			Eventually(session.Err, "10s").Should(gbytes.Say("Stopping to tail removed file: .*" + logfileName))
+
+			var err error
+			logFile, err = os.Create(logFile.Name())
+			Expect(err).NotTo(HaveOccurred())
+			Write(logFile, "after the removal\n", true, false)
+
+			Eventually(session.Err, "10s").Should(gbytes.Say("Resuming file .*" + logfileName + " from offset 0"))
+			Eventually(buffer, "5s").Should(gbytes.Say("after the removal"))
+		})
+
+		It("stops tailing an idle file and resumes it once it grows", func() {
+			start(time.Second)
+			Write(logFile, "before going idle\n", true, false)
+			Eventually(buffer, "5s").Should(gbytes.Say("before going idle"))
+
+			Eventually(session.Err, "10s").Should(gbytes.Say("Stopping to tail idle file: .*" + logfileName))
+			Write(logFile, "while evicted\n", true, false)
+
+			Eventually(session.Err, "10s").Should(gbytes.Say("Resuming file .*" + logfileName))
+			Eventually(buffer, "5s").Should(gbytes.Say("while evicted"))
+			Expect(strings.Count(string(buffer.Contents()), "before going idle")).To(Equal(1))
+		})
+	})
+
+	Context("when the config file is reloaded", func() {
+		var (
+			firstAddress, secondAddress string
+			firstBuffer, secondBuffer   *gbytes.Buffer
+			firstServer, secondServer   ifrit.Process
+			configPath                  string
+			session                     *gexec.Session
+		)
+
+		buildConfig := func(address string) blackbox.Config {
+			return blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   address,
+					},
+					SourceDir: logDir,
+				},
+			}
+		}
+
+		reload := func(contents []byte) {
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+			Expect(session.Command.Process.Signal(syscall.SIGHUP)).To(Succeed())
+		}
+
+		reloadWithConfig := func(config blackbox.Config) {
+			contents, err := yaml.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			reload(contents)
+		}
+
+		BeforeEach(func() {
+			firstAddress = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			secondAddress = fmt.Sprintf("127.0.0.1:%d", 9190+GinkgoParallelProcess())
+			firstBuffer = gbytes.NewBuffer()
+			secondBuffer = gbytes.NewBuffer()
+			firstServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: firstAddress, Buffer: firstBuffer})
+			secondServer = ginkgomon.Invoke(&TcpSyslogServer{Addr: secondAddress, Buffer: secondBuffer})
+		})
+
+		JustBeforeEach(func() {
+			configPath = CreateConfigFile(buildConfig(firstAddress))
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session.Err, "10s").Should(gbytes.Say("Starting to tail file:"))
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			os.Remove(configPath)
+			ginkgomon.Interrupt(firstServer)
+			ginkgomon.Interrupt(secondServer)
+		})
+
+		It("starts and stops tailing files the exclude pattern changed for", func() {
+			otherFile, err := os.Create(filepath.Join(logDir, tagName, "other.log"))
+			Expect(err).NotTo(HaveOccurred())
+			defer otherFile.Close()
+
+			config := buildConfig(firstAddress)
+			config.Syslog.ExcludeFilePattern = logfileName
+			reloadWithConfig(config)
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Stopping to tail file: .*" + logfileName))
+			Eventually(session.Err, "5s").Should(gbytes.Say("Starting to tail file: .*other.log"))
+			time.Sleep(2 * time.Second)
+
+			Write(otherFile, "from the other file\n", true, false)
+			Write(logFile, "from the excluded file\n", true, false)
+
+			Eventually(firstBuffer, "5s").Should(gbytes.Say("from the other file"))
+			Consistently(firstBuffer, "2s").ShouldNot(gbytes.Say("from the excluded file"))
+		})
+
+		It("sends messages to a changed destination without restarting", func() {
+			Write(logFile, "before reloading\n", true, false)
+			Eventually(firstBuffer, "5s").Should(gbytes.Say("before reloading"))
+
+			reloadWithConfig(buildConfig(secondAddress))
+			Eventually(session.Err, "5s").Should(gbytes.Say("Reloaded config file"))
+
+			Write(logFile, "after reloading\n", true, false)
+			Eventually(secondBuffer, "5s").Should(gbytes.Say("after reloading"))
+			Consistently(firstBuffer).ShouldNot(gbytes.Say("after reloading"))
+			Expect(session.Err).NotTo(gbytes.Say("Starting to tail file:"))
+		})
+
+		It("sends messages held back for a destination that is down to the new destination", func() {
+			ginkgomon.Interrupt(firstServer)
+
+			Write(logFile, "held back\n", true, false)
+			Eventually(session.Err, "5s").Should(gbytes.Say("Error connecting"))
+
+			reloadWithConfig(buildConfig(secondAddress))
+
+			Eventually(secondBuffer, "10s").Should(gbytes.Say("held back"))
+		})
+
+		It("keeps the current config if the new one is invalid", func() {
+			reload([]byte("syslog: [\n"))
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("keeping the current config"))
+			Consistently(session).ShouldNot(gexec.Exit())
+
+			Write(logFile, "still here\n", true, false)
+			Eventually(firstBuffer, "5s").Should(gbytes.Say("still here"))
+		})
+	})
+
+	Context("When the server uses tls", func() {
+		var address string
+		var buffer *gbytes.Buffer
+		var tlsserver TLSSyslogServer
+		var blackboxRunner *BlackboxRunner
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			tlsserver = TLSSyslogServer{
+				Addr:   address,
+				Buffer: buffer,
+			}
+			err := tlsserver.Run()
+			Expect(err).ToNot(HaveOccurred())
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			tlsserver.Stop()
+		})
+
+		It("can send messages using tls", func() {
+			blackboxConfig := blackbox.Config{
+				Hostname: "",
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tls",
+						Address:   address,
+						CA:        "./fixtures/ca.crt",
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(blackboxConfig, 1)
+			Write(logFile, "hello\n", true, true)
+
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+
+			blackboxRunner.Stop()
+		})
+	})
+
+	Context("When the server requires client certificates", func() {
+		var address string
+		var buffer, clientNames *gbytes.Buffer
+		var tlsserver TLSSyslogServer
+		var blackboxRunner *BlackboxRunner
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			clientNames = gbytes.NewBuffer()
+			tlsserver = TLSSyslogServer{
+				Addr:              address,
+				Buffer:            buffer,
+				RequireClientCert: true,
+				ClientNames:       clientNames,
+			}
+			err := tlsserver.Run()
+			Expect(err).ToNot(HaveOccurred())
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			tlsserver.Stop()
+		})
+
+		It("can send messages using mutual tls", func() {
+			blackboxConfig := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport:  "tls",
+						Address:    address,
+						CA:         "./fixtures/ca.crt",
+						Cert:       "./fixtures/server.crt",
+						Key:        "./fixtures/server.key",
+						ServerName: "localhost",
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(blackboxConfig, 1)
+			Write(logFile, "hello\n", true, true)
+
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+			Expect(clientNames).To(gbytes.Say("server"))
+
+			blackboxRunner.Stop()
+		})
+
+		It("uses renewed client certificates for new connections", func() {
+			certDir, err := os.MkdirTemp("", "blackbox-certs")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(certDir)
+
+			copyFile := func(from, to string) {
+				contents, err := os.ReadFile(from)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.WriteFile(to, contents, 0600)).To(Succeed())
+			}
+			certPath := filepath.Join(certDir, "client.crt")
+			keyPath := filepath.Join(certDir, "client.key")
+			copyFile("./fixtures/server-bad.crt", certPath)
+			copyFile("./fixtures/server-bad.key", keyPath)
+
+			blackboxConfig := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tls",
+						Address:   address,
+						CA:        "./fixtures/ca.crt",
+						Cert:      certPath,
+						Key:       keyPath,
+					},
+					SourceDir: logDir,
+				},
+			}
+			blackboxRunner.StartWithConfig(blackboxConfig, 1)
+			Write(logFile, "hello\n", true, false)
+
+			Eventually(buffer, "5s").Should(gbytes.Say("hello"))
+			Expect(clientNames).To(gbytes.Say("server-bad"))
+
+			copyFile("./fixtures/server.crt", certPath)
+			copyFile("./fixtures/server.key", keyPath)
+			modTime := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(certPath, modTime, modTime)).To(Succeed())
+			Expect(os.Chtimes(keyPath, modTime, modTime)).To(Succeed())
+
+			tlsserver.Stop()
+			Expect(tlsserver.Run()).To(Succeed())
+
+			Eventually(func() *gbytes.Buffer {
+				Write(logFile, "reconnect\n", true, false)
+				return clientNames
+			}, "10s", "500ms").Should(gbytes.Say("server\n"))
+
+			blackboxRunner.Stop()
+		})
+	})
+
+	Context("When the server uses bad tls", func() {
+		var address string
+		var buffer *gbytes.Buffer
+		var tlsserver TLSSyslogServer
+		var blackboxRunner *BlackboxRunner
+
+		BeforeEach(func() {
+			address = fmt.Sprintf("127.0.0.1:%d", 9090+GinkgoParallelProcess())
+			buffer = gbytes.NewBuffer()
+			tlsserver = TLSSyslogServer{
+				Addr:               address,
+				Buffer:             buffer,
+				CertPrefixOverride: "./fixtures/server-bad",
+			}
+			err := tlsserver.Run()
+			Expect(err).ToNot(HaveOccurred())
+			blackboxRunner = NewBlackboxRunner(blackboxPath)
+		})
+
+		AfterEach(func() {
+			tlsserver.Stop()
 		})
 
 		It("doesn't cause blackbox to fail", func() {
@@ -851,6 +2988,104 @@ var _ = Describe("Blackbox", func() {
 			})
 		})
 	})
+
+	Context("when the config file is invalid", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configFile, err := os.CreateTemp("", "blackbox_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer configFile.Close()
+
+			_, err = fmt.Fprintf(configFile, `
+hostname: some-host
+max_mesage_size: 1024
+syslog:
+  source_dir: %s/missing
+  destination:
+    transport: tpc
+    address: 127.0.0.1:514
+    ca: /does/not/exist/ca.crt
+  discovery: inotify
+catch_up_rotated: true
+`, logDir)
+			Expect(err).NotTo(HaveOccurred())
+			configPath = configFile.Name()
+		})
+
+		AfterEach(func() {
+			os.Remove(configPath)
+		})
+
+		It("reports every problem when validating it", func() {
+			session, err := gexec.Start(exec.Command(blackboxPath, "validate", "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(session.Wait("5s")).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("is invalid"))
+			Expect(session.Err).To(gbytes.Say("field max_mesage_size not found"))
+			Expect(session.Err).To(gbytes.Say("syslog.source_dir: .*missing"))
+			Expect(session.Err).To(gbytes.Say(`syslog.destination.transport: unknown transport "tpc"`))
+			Expect(session.Err).To(gbytes.Say("syslog.destination.ca: .*/does/not/exist/ca.crt"))
+			Expect(session.Err).To(gbytes.Say(`syslog.discovery: unknown discovery mode "inotify"`))
+			Expect(session.Err).To(gbytes.Say("catch_up_rotated: needs a state_dir"))
+		})
+
+		It("reports a local destination as the primary of a failover group", func() {
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destinations: []blackbox.DestinationGroup{
+						{
+							Mode: "failover",
+							Destinations: []syslog.Drain{
+								{Transport: syslog.TransportStdout},
+								{Transport: "tcp", Address: "127.0.0.1:514"},
+							},
+						},
+					},
+					SourceDir: logDir,
+				},
+			}
+			contents, err := yaml.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "validate", "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(session.Wait("5s")).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("syslog.destinations\\[0\\].destinations\\[0\\].transport: stdout cannot be the primary of a failover group"))
+		})
+
+		It("refuses to start", func() {
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(session.Wait("5s")).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("could not load config file"))
+		})
+
+		It("accepts it once the problems are fixed", func() {
+			config := blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   "127.0.0.1:514",
+					},
+					SourceDir: logDir,
+				},
+			}
+			contents, err := yaml.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(configPath, contents, 0600)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "validate", "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(session.Wait("5s")).To(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("is valid"))
+		})
+	})
 })
 
 func Write(file *os.File, line string, sync bool, close bool) {
@@ -865,3 +3100,23 @@ func Write(file *os.File, line string, sync bool, close bool) {
 		Expect(err).ToNot(HaveOccurred())
 	}
 }
+
+// OctetCountedMessages splits the octet-counted frames received by a server
+// into messages, leaving out a partly received one at the end.
+func OctetCountedMessages(contents []byte) []string {
+	var messages []string
+	for len(contents) > 0 {
+		length, rest, found := strings.Cut(string(contents), " ")
+		if !found {
+			break
+		}
+		size, err := strconv.Atoi(length)
+		Expect(err).NotTo(HaveOccurred())
+		if len(rest) < size {
+			break
+		}
+		messages = append(messages, rest[:size])
+		contents = []byte(rest[size:])
+	}
+	return messages
+}
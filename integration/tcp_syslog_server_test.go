@@ -6,13 +6,16 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/onsi/gomega/gbytes"
 )
 
 type TcpSyslogServer struct {
-	Addr   string
-	Buffer *gbytes.Buffer
+	Addr     string
+	Buffer   *gbytes.Buffer
+	Accepted atomic.Int32
 }
 
 func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
@@ -28,17 +31,25 @@ func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 
 	close(ready)
 
-	var conn net.Conn
+	// the connection being read, which is closed once signalled
+	var (
+		lock sync.Mutex
+		conn net.Conn
+	)
 
 	go func() {
 		for {
 			// Listen for an incoming connection.
-			conn, err = l.Accept()
+			accepted, err := l.Accept()
 			if err != nil {
 				return
 			}
+			s.Accepted.Add(1)
+			lock.Lock()
+			conn = accepted
+			lock.Unlock()
 
-			_, err = io.Copy(s.Buffer, conn)
+			_, err = io.Copy(s.Buffer, accepted)
 
 			// io.Copy is blocking. So when we close the underlying connection after
 			// being signalled, we need to check for that error
@@ -52,14 +63,16 @@ func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 				panic(err)
 			}
 
-			conn.Close()
+			accepted.Close()
 		}
 	}()
 
 	<-signals
+	lock.Lock()
 	if conn != nil {
 		conn.Close()
 	}
+	lock.Unlock()
 
 	return nil
 }
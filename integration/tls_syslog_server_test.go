@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 
 	. "github.com/onsi/ginkgo/v2"
 
@@ -20,7 +21,12 @@ type TLSSyslogServer struct {
 	Addr               string
 	CertPrefixOverride string
 	Buffer             *gbytes.Buffer
+	RequireClientCert  bool
+	ClientNames        *gbytes.Buffer
 	l                  net.Listener
+
+	lock  sync.Mutex
+	conns []net.Conn
 }
 
 func (s *TLSSyslogServer) Run() error {
@@ -46,6 +52,10 @@ func (s *TLSSyslogServer) Run() error {
 		return err
 	}
 	config := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cer}} //nolint:gosec
+	if s.RequireClientCert {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
 	// Listen for incoming connections.
 	s.l, err = tls.Listen("tcp", s.Addr, config)
@@ -66,6 +76,20 @@ func (s *TLSSyslogServer) Run() error {
 				return
 			}
 			defer conn.Close()
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+
+			if s.ClientNames != nil {
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				for _, cert := range tlsConn.ConnectionState().PeerCertificates[:1] {
+					fmt.Fprintln(s.ClientNames, cert.Subject.CommonName)
+				}
+			}
 
 			_, err = io.Copy(s.Buffer, conn)
 
@@ -89,4 +113,11 @@ func (s *TLSSyslogServer) Run() error {
 
 func (s *TLSSyslogServer) Stop() {
 	s.l.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
 }
@@ -0,0 +1,15 @@
+package blackbox
+
+import "code.cloudfoundry.org/blackbox/metrics"
+
+var (
+	linesRead    = metrics.NewCounter("blackbox_lines_read_total", "Lines read from a file.", "tag", "path")
+	drainErrors  = metrics.NewCounter("blackbox_drain_errors_total", "Lines from a file that could not be drained.", "tag", "path")
+	watchedFiles = metrics.NewGauge("blackbox_watched_files", "Files currently tailed.", "source")
+)
+
+// deleteFileMetrics removes the series of the file at path read with tag.
+func deleteFileMetrics(tag, path string) {
+	linesRead.Delete(tag, path)
+	drainErrors.Delete(tag, path)
+}
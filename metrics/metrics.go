@@ -0,0 +1,208 @@
+// Package metrics keeps counters and gauges in memory and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry metrics are added to when they are created.
+var Default = &Registry{}
+
+// Registry is a set of metrics that are served together.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []*metric
+}
+
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	lock   sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter is a value that only goes up, such as the number of lines read.
+type Counter struct {
+	metric *metric
+}
+
+// Gauge is a value that goes up and down, such as the number of files
+// watched.
+type Gauge struct {
+	metric *metric
+}
+
+// NewCounter adds a counter to the default registry. Every time it is changed
+// it is given a value for each of labelNames.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{metric: Default.add(name, help, "counter", labelNames)}
+}
+
+// NewGauge adds a gauge to the default registry. Every time it is changed it
+// is given a value for each of labelNames.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{metric: Default.add(name, help, "gauge", labelNames)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.metric.update(labelValues, func(v *value) { v.value += delta })
+}
+
+// Value returns the current value of the counter for labelValues.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.metric.get(labelValues)
+}
+
+// Delete removes the value of the counter for labelValues, for labels such as
+// files that are gone for good.
+func (c *Counter) Delete(labelValues ...string) {
+	c.metric.delete(labelValues)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.metric.update(labelValues, func(value *value) { value.value = v })
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.metric.update(labelValues, func(v *value) { v.value += delta })
+}
+
+// Value returns the current value of the gauge for labelValues.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.metric.get(labelValues)
+}
+
+func (r *Registry) add(name, help, kind string, labelNames []string) *metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	m := &metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     map[string]*value{},
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// WriteTo writes all metrics of the registry in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.writeTo(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w) //nolint:errcheck
+	})
+}
+
+func (m *metric) update(labelValues []string, update func(*value)) {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	v, found := m.values[key]
+	if !found {
+		v = &value{labelValues: append([]string(nil), labelValues...)}
+		m.values[key] = v
+	}
+	update(v)
+}
+
+func (m *metric) get(labelValues []string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if v, found := m.values[strings.Join(labelValues, "\xff")]; found {
+		return v.value
+	}
+	return 0
+}
+
+func (m *metric) delete(labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.values, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metric) writeTo(b *strings.Builder) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := m.values[key]
+		b.WriteString(m.name)
+		if len(m.labelNames) > 0 {
+			b.WriteByte('{')
+			for i, name := range m.labelNames {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(name)
+				b.WriteString(`="`)
+				b.WriteString(escapeLabelValue(v.labelValues[i]))
+				b.WriteByte('"')
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(v.value, 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
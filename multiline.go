@@ -0,0 +1,114 @@
+package blackbox
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines     = 500
+	defaultMultilineMaxBytes     = 64 * 1024
+	defaultMultilineFlushTimeout = 1 * time.Second
+)
+
+type MultilineConfig struct {
+	Tag                 string        `yaml:"tag"`
+	StartPattern        string        `yaml:"start_pattern"`
+	ContinuationPattern string        `yaml:"continuation_pattern"`
+	MaxLines            int           `yaml:"max_lines"`
+	MaxBytes            int           `yaml:"max_bytes"`
+	FlushTimeout        time.Duration `yaml:"flush_timeout"`
+}
+
+// MultilineRule decides which lines of a file belong to the same event, e.g.
+// the lines of a stack trace.
+type MultilineRule struct {
+	tag          string
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	maxLines     int
+	maxBytes     int
+	flushTimeout time.Duration
+}
+
+func NewMultilineRules(configs []MultilineConfig) ([]*MultilineRule, error) {
+	var rules []*MultilineRule
+
+	for _, config := range configs {
+		if (config.StartPattern == "") == (config.ContinuationPattern == "") {
+			return nil, fmt.Errorf("multiline config for tag %q needs exactly one of start_pattern and continuation_pattern", config.Tag)
+		}
+		if config.MaxLines < 0 || config.MaxBytes < 0 || config.FlushTimeout < 0 {
+			return nil, errors.New("multiline limits must not be negative")
+		}
+
+		rule := &MultilineRule{
+			tag:          config.Tag,
+			maxLines:     config.MaxLines,
+			maxBytes:     config.MaxBytes,
+			flushTimeout: config.FlushTimeout,
+		}
+
+		var err error
+		if config.StartPattern != "" {
+			rule.start, err = regexp.Compile(config.StartPattern)
+		} else {
+			rule.continuation, err = regexp.Compile(config.ContinuationPattern)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rule.maxLines == 0 {
+			rule.maxLines = defaultMultilineMaxLines
+		}
+		if rule.maxBytes == 0 {
+			rule.maxBytes = defaultMultilineMaxBytes
+		}
+		if rule.flushTimeout == 0 {
+			rule.flushTimeout = defaultMultilineFlushTimeout
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func findMultilineRule(rules []*MultilineRule, tag string) *MultilineRule {
+	for _, rule := range rules {
+		if rule.tag == "" || rule.tag == tag {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *MultilineRule) startsEvent(line string) bool {
+	if r.start != nil {
+		return r.start.MatchString(line)
+	}
+	return !r.continuation.MatchString(line)
+}
+
+type multilineEvent struct {
+	lines  []string
+	size   int
+	offset int64
+}
+
+func (e *multilineEvent) add(line string, offset int64) {
+	if len(e.lines) > 0 {
+		e.size++
+	}
+	e.lines = append(e.lines, line)
+	e.size += len(line)
+	e.offset = offset
+}
+
+func (e *multilineEvent) String() string {
+	return strings.Join(e.lines, "\n")
+}
@@ -0,0 +1,144 @@
+package blackbox
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+
+	"code.cloudfoundry.org/blackbox/syslog"
+)
+
+const severityMask = rfc5424.Priority(0x07)
+
+type PriorityOverride struct {
+	Tag         string `yaml:"tag"`
+	FilePattern string `yaml:"file_pattern"`
+	Facility    string `yaml:"facility"`
+	Severity    string `yaml:"severity"`
+}
+
+type SeverityRule struct {
+	Pattern  string `yaml:"pattern"`
+	Severity string `yaml:"severity"`
+}
+
+type priorityRule struct {
+	tag         string
+	filePattern string
+	facility    rfc5424.Priority
+	severity    rfc5424.Priority
+}
+
+type severityRule struct {
+	pattern  *regexp.Regexp
+	severity rfc5424.Priority
+}
+
+// PriorityResolver picks the syslog facility and severity for a tailed file
+// from the configured defaults and the first matching override, and the
+// severity of individual lines from the severity rules.
+type PriorityResolver struct {
+	facility      rfc5424.Priority
+	severity      rfc5424.Priority
+	rules         []priorityRule
+	severityRules []severityRule
+}
+
+func NewPriorityResolver(config SyslogConfig) (*PriorityResolver, error) {
+	resolver := &PriorityResolver{
+		facility: rfc5424.User,
+		severity: rfc5424.Info,
+	}
+
+	var err error
+	if config.Facility != "" {
+		resolver.facility, err = syslog.ParseFacility(config.Facility)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Severity != "" {
+		resolver.severity, err = syslog.ParseSeverity(config.Severity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, override := range config.PriorityOverrides {
+		rule := priorityRule{
+			tag:         override.Tag,
+			filePattern: override.FilePattern,
+			facility:    resolver.facility,
+			severity:    resolver.severity,
+		}
+		if override.FilePattern != "" {
+			if _, err := path.Match(override.FilePattern, ""); err != nil {
+				return nil, err
+			}
+		}
+		if override.Facility != "" {
+			rule.facility, err = syslog.ParseFacility(override.Facility)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if override.Severity != "" {
+			rule.severity, err = syslog.ParseSeverity(override.Severity)
+			if err != nil {
+				return nil, err
+			}
+		}
+		resolver.rules = append(resolver.rules, rule)
+	}
+
+	for _, rule := range config.SeverityRules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		severity, err := syslog.ParseSeverity(rule.Severity)
+		if err != nil {
+			return nil, err
+		}
+		resolver.severityRules = append(resolver.severityRules, severityRule{
+			pattern:  pattern,
+			severity: severity,
+		})
+	}
+
+	return resolver, nil
+}
+
+// Resolve returns the priority for a file, given the tag rules are matched
+// against and its path relative to the source directory.
+func (r *PriorityResolver) Resolve(tag, relativePath string) rfc5424.Priority {
+	relativePath = filepath.ToSlash(relativePath)
+
+	for _, rule := range r.rules {
+		if rule.tag != "" && rule.tag != tag {
+			continue
+		}
+		if rule.filePattern != "" {
+			if matched, _ := path.Match(rule.filePattern, relativePath); !matched {
+				continue
+			}
+		}
+		return rule.facility | rule.severity
+	}
+
+	return r.facility | r.severity
+}
+
+// Detect replaces the severity of priority with the one of the first severity
+// rule whose pattern matches line, keeping its facility.
+func (r *PriorityResolver) Detect(line string, priority rfc5424.Priority) rfc5424.Priority {
+	for _, rule := range r.severityRules {
+		if rule.pattern.MatchString(line) {
+			return priority&^severityMask | rule.severity
+		}
+	}
+
+	return priority
+}
@@ -0,0 +1,150 @@
+package blackbox
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/tedsuo/ifrit"
+)
+
+// Reloader applies changes to the configuration file without restarting, so
+// that no lines are missed while files are not being tailed.
+type Reloader struct {
+	logger       *log.Logger
+	path         string
+	destinations *SwappableDestinations
+	fileWatchers *FileWatchers
+
+	lock   sync.Mutex
+	config *Config
+}
+
+func NewReloader(logger *log.Logger, path string, config *Config, destinations *SwappableDestinations, fileWatchers *FileWatchers) *Reloader {
+	return &Reloader{
+		logger:       logger,
+		path:         path,
+		config:       config,
+		destinations: destinations,
+		fileWatchers: fileWatchers,
+	}
+}
+
+// Reload loads the configuration file again and applies what changed. If the
+// new configuration is invalid, the current one is kept.
+func (r *Reloader) Reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.logger.Printf("Reloading config file %s\n", r.path)
+
+	config, err := LoadConfig(r.path)
+	if err != nil {
+		r.logger.Printf("could not reload config file, keeping the current config: %s\n", err)
+		return
+	}
+	priorities, err := NewPriorityResolver(config.Syslog)
+	if err != nil {
+		r.logger.Printf("invalid syslog priority configuration, keeping the current config: %s\n", err)
+		return
+	}
+	multiline, err := NewMultilineRules(config.Syslog.Multiline)
+	if err != nil {
+		r.logger.Printf("invalid multiline configuration, keeping the current config: %s\n", err)
+		return
+	}
+
+	if destinationsChanged(r.config, config) {
+		if err := r.swapDestinations(config); err != nil {
+			r.logger.Printf("could not drain to the new destinations, keeping the current config: %s\n", err)
+			return
+		}
+	}
+
+	r.fileWatchers.Apply(config.SourceConfigs(), priorities, multiline)
+
+	if config.UseRFC3339 != r.config.UseRFC3339 ||
+		config.StateDir != r.config.StateDir ||
+		config.CatchUpRotated != r.config.CatchUpRotated ||
+		config.MetricsAddress != r.config.MetricsAddress ||
+		config.HealthCheckWindow != r.config.HealthCheckWindow {
+		r.logger.Println("use_rfc3339, state_dir, catch_up_rotated, metrics_address and health_check_window only change on restart")
+	}
+
+	r.config = config
+	r.logger.Println("Reloaded config file")
+}
+
+// swapDestinations replaces the destinations with those of config. If they
+// cannot be built, the destinations of the current config are built again.
+func (r *Reloader) swapDestinations(config *Config) error {
+	var buildErr error
+	err := r.destinations.Swap(func() (*Destinations, error) {
+		destinations, err := NewDestinations(r.logger, config)
+		if err == nil {
+			return destinations, nil
+		}
+		buildErr = err
+		return NewDestinations(r.logger, r.config)
+	})
+	if err != nil {
+		r.logger.Fatalf("could not drain to the previous destinations either: %s\n", err)
+	}
+	return buildErr
+}
+
+// destinationsChanged tells whether messages are sent differently with the
+// new config.
+func destinationsChanged(current, next *Config) bool {
+	return !reflect.DeepEqual(current.Syslog.Destination, next.Syslog.Destination) ||
+		!reflect.DeepEqual(current.Syslog.Destinations, next.Syslog.Destinations) ||
+		current.Hostname != next.Hostname ||
+		!reflect.DeepEqual(current.StructuredData(), next.StructuredData()) ||
+		current.MaxMessageSize != next.MaxMessageSize ||
+		!reflect.DeepEqual(sourceDestinations(current), sourceDestinations(next))
+}
+
+// sourceDestinations returns the destination group each source refers to and
+// the structured data it adds, by source name.
+func sourceDestinations(config *Config) map[string]any {
+	destinations := map[string]any{}
+	for _, source := range config.SourceConfigs() {
+		destinations[source.name()] = []any{source.Destination, source.StructuredData()}
+	}
+	return destinations
+}
+
+type reloadRunner struct {
+	runner ifrit.Runner
+	reload func()
+}
+
+// NewReloadRunner runs runner, calling reload on SIGHUP rather than passing
+// the signal on.
+func NewReloadRunner(runner ifrit.Runner, reload func()) ifrit.Runner {
+	return &reloadRunner{runner: runner, reload: reload}
+}
+
+func (r *reloadRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	process := ifrit.Background(r.runner)
+	pReady := process.Ready()
+	pWait := process.Wait()
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				r.reload()
+				continue
+			}
+			process.Signal(sig)
+		case <-pReady:
+			close(ready)
+			pReady = nil
+		case err := <-pWait:
+			return err
+		}
+	}
+}
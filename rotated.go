@@ -0,0 +1,151 @@
+package blackbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nxadm/tail"
+)
+
+// headSize is how many of the first bytes of a file are checkpointed to
+// recognize it once it was compressed.
+const headSize = 256
+
+// A rotatedFile is the rest of a file that was rotated while blackbox was
+// down, read from where its checkpoint was recorded.
+type rotatedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *rotatedFile) Name() string {
+	return r.file.Name()
+}
+
+func (r *rotatedFile) Close() error {
+	return r.file.Close()
+}
+
+// startsWith tells whether the file at path starts with head.
+func startsWith(path string, head []byte) bool {
+	file, err := tail.OpenFile(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	start := make([]byte, len(head))
+	if _, err := io.ReadFull(file, start); err != nil {
+		return false
+	}
+	return bytes.Equal(start, head)
+}
+
+// searchRotated calls match with the files next to path that it may have been
+// rotated to, whose names start with the name of path, most recently modified
+// first, until match returns true.
+func searchRotated(path string, match func(candidatePath string, info os.FileInfo) bool) {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var candidates []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == name || !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ModTime().After(candidates[j].ModTime())
+	})
+
+	for _, candidate := range candidates {
+		if match(filepath.Join(dir, candidate.Name()), candidate) {
+			return
+		}
+	}
+}
+
+// findRotated looks for the file checkpointed for path next to it, either
+// renamed with the same inode, or copied or compressed with gzip into a file
+// that starts like it did.
+func findRotated(path string, saved checkpoint) *rotatedFile {
+	var rotated *rotatedFile
+	searchRotated(path, func(candidatePath string, info os.FileInfo) bool {
+		if strings.HasSuffix(candidatePath, ".gz") {
+			rotated = openCompressed(candidatePath, saved)
+		} else if info.Size() >= saved.Offset && isRotated(candidatePath, saved) {
+			rotated = openRenamed(candidatePath, saved)
+		}
+		return rotated != nil
+	})
+	return rotated
+}
+
+// isRotated tells whether the uncompressed file at path is the one saved was
+// recorded for.
+func isRotated(path string, saved checkpoint) bool {
+	if inode, err := fileID(path); err == nil && inode == saved.Inode {
+		return true
+	}
+	return len(saved.Head) > 0 && startsWith(path, saved.Head)
+}
+
+func openRenamed(path string, saved checkpoint) *rotatedFile {
+	file, err := tail.OpenFile(path)
+	if err != nil {
+		return nil
+	}
+	if _, err := file.Seek(saved.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil
+	}
+	return &rotatedFile{Reader: file, file: file}
+}
+
+// openCompressed returns the rest of the gzip file at path if it decompresses
+// to contents that start with the checkpointed head and reach its offset.
+func openCompressed(path string, saved checkpoint) *rotatedFile {
+	if len(saved.Head) == 0 {
+		return nil
+	}
+
+	file, err := tail.OpenFile(path)
+	if err != nil {
+		return nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil
+	}
+
+	head := make([]byte, len(saved.Head))
+	if _, err := io.ReadFull(reader, head); err != nil || !bytes.Equal(head, saved.Head) {
+		file.Close()
+		return nil
+	}
+
+	// the head may have been read past the offset
+	if saved.Offset < int64(len(head)) {
+		return &rotatedFile{Reader: io.MultiReader(bytes.NewReader(head[saved.Offset:]), reader), file: file}
+	}
+	if _, err := io.CopyN(io.Discard, reader, saved.Offset-int64(len(head))); err != nil {
+		file.Close()
+		return nil
+	}
+	return &rotatedFile{Reader: reader, file: file}
+}
@@ -0,0 +1,278 @@
+package blackbox
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+	"github.com/tedsuo/ifrit/grouper"
+
+	"code.cloudfoundry.org/blackbox/syslog"
+)
+
+// Strategies for tagging the files of a source.
+const (
+	// TagStrategyDirectory tags a file with its directory relative to the
+	// source dir, or with its own path relative to it if log_filename is set.
+	// Only files in sub-directories are tailed.
+	TagStrategyDirectory = "directory"
+	// TagStrategyFixed tags every file with the tag of the source, which
+	// also tails the files directly in the source dir.
+	TagStrategyFixed = "fixed"
+
+	defaultIncludeFilePattern = "**/*.log"
+)
+
+// Where a source starts reading the files it has no checkpoint for.
+const (
+	// StartPositionEnd only reads the lines written after a file is first
+	// tailed.
+	StartPositionEnd = "end"
+	// StartPositionBeginning reads every file from its beginning.
+	StartPositionBeginning = "beginning"
+	// StartPositionBeginningForNewFiles reads the files present when the
+	// source dir is first scanned from their end, and the files found after
+	// that from their beginning, so that the lines written to a new file
+	// before it is found are not lost.
+	StartPositionBeginningForNewFiles = "beginning_for_new_files"
+)
+
+func validateStartPosition(startPosition string) error {
+	switch startPosition {
+	case "", StartPositionEnd, StartPositionBeginning, StartPositionBeginningForNewFiles:
+		return nil
+	default:
+		return fmt.Errorf("unknown start position %q, must be %s, %s or %s", startPosition, StartPositionEnd, StartPositionBeginning, StartPositionBeginningForNewFiles)
+	}
+}
+
+// SourceConfig configures a directory to tail files from.
+type SourceConfig struct {
+	Name                string            `yaml:"name"`
+	Dir                 string            `yaml:"dir"`
+	IncludeFilePatterns []string          `yaml:"include_file_patterns"`
+	ExcludeFilePatterns []string          `yaml:"exclude_file_patterns"`
+	TagStrategy         string            `yaml:"tag_strategy"`
+	Tag                 string            `yaml:"tag"`
+	LogFilename         bool              `yaml:"log_filename"`
+	StructuredDataID    string            `yaml:"structured_data_id"`
+	StructuredDataMap   map[string]string `yaml:"structured_data_map"`
+	Destination         string            `yaml:"destination"`
+	Discovery           string            `yaml:"discovery"`
+	IdleTimeout         time.Duration     `yaml:"idle_timeout"`
+	StartPosition       string            `yaml:"start_position"`
+}
+
+// name identifies the source, defaulting to its dir.
+func (s SourceConfig) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Dir
+}
+
+// StructuredData returns the structured data added to the messages of the
+// source instead of the one of the config, if any.
+func (s SourceConfig) StructuredData() rfc5424.StructuredData {
+	return structuredData(s.StructuredDataID, s.StructuredDataMap)
+}
+
+// filePatterns returns the patterns selecting the files of the source. An
+// include pattern starting with ! excludes the files it matches, and without
+// any other include pattern every .log file is included.
+func (s SourceConfig) filePatterns() filePatterns {
+	patterns := filePatterns{exclude: slices.Clone(s.ExcludeFilePatterns)}
+	for _, pattern := range s.IncludeFilePatterns {
+		if negated, found := strings.CutPrefix(pattern, "!"); found {
+			patterns.exclude = append(patterns.exclude, negated)
+		} else {
+			patterns.include = append(patterns.include, pattern)
+		}
+	}
+	if len(patterns.include) == 0 {
+		patterns.include = []string{defaultIncludeFilePattern}
+	}
+	return patterns
+}
+
+// filePatterns select files by their slash separated path relative to the
+// source dir. A file is tailed if it matches any include pattern and no
+// exclude pattern.
+type filePatterns struct {
+	include []string
+	exclude []string
+}
+
+func (p filePatterns) match(relativePath string) bool {
+	return slices.ContainsFunc(p.include, func(pattern string) bool {
+		return matchGlob(pattern, relativePath)
+	}) && !slices.ContainsFunc(p.exclude, func(pattern string) bool {
+		return matchGlob(pattern, relativePath)
+	})
+}
+
+// excludesDir tells whether every file in the dir at relativePath is
+// excluded, so that it need not be scanned.
+func (p filePatterns) excludesDir(relativePath string) bool {
+	return slices.ContainsFunc(p.exclude, func(pattern string) bool {
+		dirPattern, found := strings.CutSuffix(pattern, "/**")
+		return found && matchGlob(dirPattern, relativePath)
+	})
+}
+
+// validateFilePatterns checks the include and exclude patterns of a source.
+func validateFilePatterns(include, exclude []string) error {
+	var errs []error
+	for i, pattern := range include {
+		if err := validateGlob(strings.TrimPrefix(pattern, "!")); err != nil {
+			errs = append(errs, &syslog.FieldError{Field: fmt.Sprintf("include_file_patterns[%d]", i), Err: err})
+		}
+	}
+	for i, pattern := range exclude {
+		if err := validateGlob(pattern); err != nil {
+			errs = append(errs, &syslog.FieldError{Field: fmt.Sprintf("exclude_file_patterns[%d]", i), Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the source, which may refer to any of the named
+// destination groups.
+func (s SourceConfig) validate(groupNames map[string]bool) error {
+	var errs []error
+	check := func(field string, err error) {
+		errs = append(errs, syslog.FieldErrors(field, err)...)
+	}
+
+	if s.Dir == "" {
+		check("dir", errors.New("must be set"))
+	} else {
+		check("dir", checkSourceDir(s.Dir))
+	}
+	errs = append(errs, validateFilePatterns(s.IncludeFilePatterns, s.ExcludeFilePatterns))
+
+	switch s.TagStrategy {
+	case "", TagStrategyDirectory:
+		if s.Tag != "" {
+			check("tag", fmt.Errorf("is only used with the %s tag strategy", TagStrategyFixed))
+		}
+	case TagStrategyFixed:
+		if s.Tag == "" {
+			check("tag", fmt.Errorf("must be set for the %s tag strategy", TagStrategyFixed))
+		}
+		if s.LogFilename {
+			check("log_filename", fmt.Errorf("is only used with the %s tag strategy", TagStrategyDirectory))
+		}
+	default:
+		check("tag_strategy", fmt.Errorf("unknown tag strategy %q", s.TagStrategy))
+	}
+
+	if s.StructuredDataID == "" && len(s.StructuredDataMap) > 0 {
+		check("structured_data_map", errors.New("needs a structured_data_id"))
+	}
+
+	if s.Destination != "" && !groupNames[s.Destination] {
+		check("destination", fmt.Errorf("no destination group is named %q", s.Destination))
+	}
+	check("discovery", validateDiscovery(s.Discovery))
+	if s.IdleTimeout < 0 {
+		check("idle_timeout", errors.New("must not be negative"))
+	}
+	check("start_position", validateStartPosition(s.StartPosition))
+
+	return errors.Join(errs...)
+}
+
+// checkSourceDir makes sure the dir of a source exists, as it is scanned
+// right away.
+func checkSourceDir(sourceDir string) error {
+	info, err := os.Stat(sourceDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", sourceDir)
+	}
+	return nil
+}
+
+// FileWatchers are the file watchers of all sources, which run their tailers
+// in the same group and share the destinations.
+type FileWatchers struct {
+	logger             *log.Logger
+	dynamicGroupClient grouper.DynamicClient
+	destinations       *SwappableDestinations
+	checkpoints        *CheckpointStore
+
+	lock     sync.Mutex
+	applied  bool
+	watchers map[string]*fileWatcher
+	scanned  chan struct{}
+}
+
+func NewFileWatchers(logger *log.Logger, dynamicGroupClient grouper.DynamicClient, destinations *SwappableDestinations, checkpoints *CheckpointStore) *FileWatchers {
+	return &FileWatchers{
+		logger:             logger,
+		dynamicGroupClient: dynamicGroupClient,
+		destinations:       destinations,
+		checkpoints:        checkpoints,
+		watchers:           map[string]*fileWatcher{},
+		scanned:            make(chan struct{}),
+	}
+}
+
+// Scanned is closed once the dirs of the sources first applied have been
+// scanned, so that every file present at startup is being tailed.
+func (w *FileWatchers) Scanned() <-chan struct{} {
+	return w.scanned
+}
+
+// Apply starts watching the dirs of new sources, reloads the watchers of
+// sources that are still there and stops the watchers of sources that are
+// gone.
+func (w *FileWatchers) Apply(sources []SourceConfig, priorities *PriorityResolver, multiline []*MultilineRule) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	kept := map[string]bool{}
+	var started []*fileWatcher
+
+	for _, source := range sources {
+		name := source.name()
+		kept[name] = true
+
+		if watcher, found := w.watchers[name]; found {
+			watcher.Reload(source, priorities, multiline)
+			continue
+		}
+
+		watcher := NewFileWatcher(w.logger, source, w.dynamicGroupClient, w.destinations.For(name), w.checkpoints, priorities, multiline)
+		w.watchers[name] = watcher
+		started = append(started, watcher)
+		go watcher.Watch()
+	}
+
+	for name, watcher := range w.watchers {
+		if !kept[name] {
+			w.logger.Printf("Stopping to watch source: %s", name)
+			watcher.Stop()
+			delete(w.watchers, name)
+		}
+	}
+
+	if !w.applied {
+		w.applied = true
+		go func() {
+			for _, watcher := range started {
+				<-watcher.Scanned()
+			}
+			close(w.scanned)
+		}()
+	}
+}
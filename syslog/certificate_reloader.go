@@ -0,0 +1,88 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateReloader loads a client certificate from disk and reloads it
+// whenever the certificate or key file changes, so that renewed certificates
+// are used for new connections without a restart.
+type certificateReloader struct {
+	certPath    string
+	keyPath     string
+	errorLogger *log.Logger
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertificateReloader(certPath string, keyPath string, errorLogger *log.Logger) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certPath:    certPath,
+		keyPath:     keyPath,
+		errorLogger: errorLogger,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// load must be called with the lock held.
+func (r *certificateReloader) load() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.certificate = &certificate
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+
+	return nil
+}
+
+func (r *certificateReloader) changed() bool {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+func (r *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.changed() {
+		if err := r.load(); err != nil {
+			r.errorLogger.Printf("Error reloading client certificate, using the previous one: %s\n", err)
+		} else {
+			r.errorLogger.Printf("Reloaded client certificate %s\n", r.certPath)
+		}
+	}
+
+	return r.certificate, nil
+}
@@ -1,13 +1,18 @@
 package syslog
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/tlsconfig"
@@ -16,47 +21,227 @@ import (
 )
 
 type Drain struct {
-	Transport  string `yaml:"transport"`
-	Address    string `yaml:"address"`
-	CA         string `yaml:"ca"`
-	MaxRetries int    `yaml:"max_retries"`
+	Transport      string        `yaml:"transport"`
+	Address        string        `yaml:"address"`
+	CA             string        `yaml:"ca"`
+	Cert           string        `yaml:"cert"`
+	Key            string        `yaml:"key"`
+	ServerName     string        `yaml:"server_name"`
+	MaxRetries     int           `yaml:"max_retries"`
+	Connections    int           `yaml:"connections"`
+	Framing        string        `yaml:"framing"`
+	Format         string        `yaml:"format"`
+	OversizePolicy string        `yaml:"oversize_policy"`
+	BatchSize      int           `yaml:"batch_size"`
+	FlushInterval  time.Duration `yaml:"flush_interval"`
+	File           FileConfig    `yaml:"file"`
+	HTTP           HTTPConfig    `yaml:"http"`
+	Spool          SpoolConfig   `yaml:"spool"`
+}
+
+// Framings of messages sent over stream transports, as described in RFC 6587.
+const (
+	FramingOctetCounting  = "octet-counting"
+	FramingNonTransparent = "non-transparent"
+)
+
+// Message is a single log line together with the metadata needed to ship it.
+// If it has StructuredData, it is sent with it rather than with the structured
+// data of the destination.
+type Message struct {
+	Line           string
+	Tag            string
+	Path           string
+	Priority       rfc5424.Priority
+	Timestamp      time.Time
+	StructuredData rfc5424.StructuredData
+	// Sent, if set, is called once the message has been written to the
+	// destination or a spool in front of it, or dropped for good, so that
+	// whatever it was read from need not be read again.
+	Sent func() `json:"-"`
 }
 
 type Drainer interface {
-	Drain(line string, tag string) error
+	Drain(message Message) error
+}
+
+// Flusher is implemented by drainers that hold on to messages before sending
+// them. Flush makes a single attempt at sending whatever is held back.
+type Flusher interface {
+	Flush() error
 }
 
+// Flush flushes drainer if it holds on to messages.
+func Flush(drainer Drainer) error {
+	if flusher, ok := drainer.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// ErrClosed is returned when draining to a drainer that was closed, so that
+// the caller can send the message elsewhere.
+var ErrClosed = errors.New("drainer is closed")
+
+// ErrUnavailable is returned by a drainer with a spool in front of it once it
+// gave up connecting to its destination, rather than exiting, so that the
+// spool drains the message again later.
+var ErrUnavailable = errors.New("destination is unavailable")
+
+// Close closes drainer if it holds on to connections or files. A closed
+// drainer makes a last attempt at sending what it holds back and gives up
+// retrying.
+func Close(drainer Drainer) error {
+	if closer, ok := drainer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// UnsentError is returned by Close when messages that were held back could
+// not be sent.
+type UnsentError struct {
+	Messages []Message
+	Err      error
+}
+
+func (e *UnsentError) Error() string {
+	return fmt.Sprintf("%d messages were not sent: %s", len(e.Messages), e.Err)
+}
+
+func (e *UnsentError) Unwrap() error {
+	return e.Err
+}
+
+// sent calls the Sent callbacks of messages.
+func sent(messages []Message) {
+	for _, message := range messages {
+		if message.Sent != nil {
+			message.Sent()
+		}
+	}
+}
+
+// Unsent returns the messages of every UnsentError in err, so that they can
+// be sent elsewhere.
+func Unsent(err error) []Message {
+	var messages []Message
+	switch e := err.(type) {
+	case *UnsentError:
+		messages = append(messages, e.Messages...)
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			messages = append(messages, Unsent(err)...)
+		}
+	}
+	return messages
+}
+
+// drainer sends messages over a single connection. It is safe for concurrent
+// use, messages are sent one at a time. Over stream transports, messages are
+// collected and written together once batchSize bytes are pending or
+// flushInterval has passed since the first of them.
 type drainer struct {
+	closed         atomic.Bool
+	done           chan struct{}
+	lock           sync.Mutex
 	conn           net.Conn
+	connClosed     chan struct{}
+	state          *destinationState
+	pending        []byte
+	pendingCount   int
+	unsent         []Message
+	flushScheduled bool
+	handOver       func(messages []Message)
+	batchSize      int
+	flushInterval  time.Duration
 	dialFunction   func() (net.Conn, error)
 	errorLogger    *log.Logger
 	hostname       string
 	structuredData rfc5424.StructuredData
 	maxMessageSize int
 	transport      string
+	framing        string
+	format         string
+	oversizePolicy string
+	dropped        int
+	address        string
 	maxRetries     int
+	spooled        bool
 	connAttempts   int
 	sleepSeconds   int
 }
 
+const (
+	processID            = "rs2"
+	maxUDPMessageSize    = 1024
+	defaultBatchSize     = 64 * 1024
+	defaultFlushInterval = 100 * time.Millisecond
+)
+
 func NewDrainer(errorLogger *log.Logger, drain Drain, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int) (*drainer, error) {
-	tlsConf, err := generateTLSConfig(drain.CA)
+	framing := drain.Framing
+	switch framing {
+	case "":
+		framing = FramingOctetCounting
+	case FramingOctetCounting, FramingNonTransparent:
+	default:
+		return nil, fmt.Errorf("unknown framing: %q", drain.Framing)
+	}
+
+	format := drain.Format
+	switch format {
+	case "":
+		format = FormatRFC5424
+	case FormatRFC5424, FormatRFC3164:
+	default:
+		return nil, fmt.Errorf("unknown format: %q", drain.Format)
+	}
+
+	tlsConf, err := generateTLSConfig(drain, errorLogger)
 	if err != nil {
 		errorLogger.Println("Error generating TLS config: ", err)
 		return nil, err
 	}
 
 	dialFunction := generateDialer(drain, tlsConf)
+	if dialFunction == nil {
+		return nil, fmt.Errorf("unknown transport: %q", drain.Transport)
+	}
+
+	switch drain.OversizePolicy {
+	case "", OversizePolicyTruncate, OversizePolicySplit, OversizePolicyDrop:
+	default:
+		return nil, fmt.Errorf("unknown oversize policy: %q", drain.OversizePolicy)
+	}
+
+	batchSize := drain.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	flushInterval := drain.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
 
 	return &drainer{
 		hostname:       hostname,
 		structuredData: structuredData,
 		errorLogger:    errorLogger,
-		maxMessageSize: maxMessageSize,
+		state:          trackDestination(drain.Address),
+		maxMessageSize: MaxMessageSizeFor(drain, maxMessageSize),
+		oversizePolicy: drain.OversizePolicy,
 		dialFunction:   dialFunction,
 		transport:      drain.Transport,
+		framing:        framing,
+		format:         format,
+		address:        drain.Address,
 		maxRetries:     drain.MaxRetries,
+		spooled:        drain.Spool.Dir != "",
+		batchSize:      batchSize,
+		flushInterval:  flushInterval,
 		sleepSeconds:   1,
+		done:           make(chan struct{}),
 	}, nil
 }
 
@@ -83,85 +268,376 @@ func generateDialer(drain Drain, tlsConf *tls.Config) func() (net.Conn, error) {
 	return dialFunction
 }
 
-func generateTLSConfig(caString string) (*tls.Config, error) {
-	if len(caString) == 0 {
+func generateTLSConfig(drain Drain, errorLogger *log.Logger) (*tls.Config, error) {
+	if len(drain.CA) == 0 && len(drain.Cert) == 0 && len(drain.ServerName) == 0 {
 		return nil, nil
 	}
+	if (len(drain.Cert) == 0) != (len(drain.Key) == 0) {
+		return nil, errors.New("both cert and key must be set for a client certificate")
+	}
 
-	ca, err := os.ReadFile(caString)
-	if err != nil {
-		return nil, fmt.Errorf("error reading CA certificate: %w", err)
+	tlsOptions := []tlsconfig.TLSOption{tlsconfig.WithExternalServiceDefaults()}
+	var clientOptions []tlsconfig.ClientOption
+
+	if len(drain.CA) != 0 {
+		ca, err := os.ReadFile(drain.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %w", err)
+		}
+
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(ca)
+		clientOptions = append(clientOptions, tlsconfig.WithAuthority(certPool))
+	}
+
+	var reloader *certificateReloader
+	if len(drain.Cert) != 0 {
+		var err error
+		reloader, err = newCertificateReloader(drain.Cert, drain.Key, errorLogger)
+		if err != nil {
+			return nil, err
+		}
+		tlsOptions = append(tlsOptions, tlsconfig.WithIdentity(*reloader.certificate))
+	}
+
+	if len(drain.ServerName) != 0 {
+		clientOptions = append(clientOptions, tlsconfig.WithServerName(drain.ServerName))
 	}
 
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(ca)
-	tlsConf, err := tlsconfig.Build(
-		tlsconfig.WithExternalServiceDefaults(),
-	).Client(
-		tlsconfig.WithAuthority(certPool),
-	)
+	tlsConf, err := tlsconfig.Build(tlsOptions...).Client(clientOptions...)
 	if err != nil {
 		return nil, err
 	}
 
+	if reloader != nil {
+		tlsConf.GetClientCertificate = reloader.GetClientCertificate
+	}
+
 	return tlsConf, nil
 }
 
-func (d *drainer) Drain(line string, tag string) error {
-	defer d.resetAttempts()
+func (d *drainer) Drain(message Message) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
 
-	binary, err := d.formatMessage(line, tag)
+	messages, err := d.formatMessage(message)
 	if err != nil {
 		return err
 	}
-	for {
-		d.ensureConnection()
-		err = d.conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
-		if err != nil {
+	// kept for Close to hand over if the batch cannot be written, and
+	// acknowledged once it is
+	start, startCount, startUnsent := len(d.pending), d.pendingCount, len(d.unsent)
+	d.unsent = append(d.unsent, message)
+	written := false
+	for _, binary := range messages {
+		d.buffer(binary)
+		if d.transport == "udp" || len(d.pending) >= d.batchSize {
+			err := d.flush()
+			if err != nil && d.handOver == nil && !written {
+				// leave the message to the caller to drain again, so that it
+				// is not written twice
+				d.withdraw(start, startCount, startUnsent)
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			written = true
+		}
+	}
+	if len(d.pending) == 0 {
+		// written right away, or dropped as too large
+		d.written()
+		return nil
+	}
+
+	if !d.flushScheduled {
+		d.flushScheduled = true
+		time.AfterFunc(d.flushInterval, d.flushPending)
+	}
+	return nil
+}
+
+// Flush makes a single attempt at writing the pending messages, which are
+// kept for the next attempt if it fails.
+func (d *drainer) Flush() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.pending) > 0 {
+		if err := d.writeOnce(); err != nil {
 			return err
 		}
-		if d.transport == "udp" {
-			_, err = d.conn.Write(binary)
-		} else {
-			_, err = d.conn.Write([]byte(strconv.Itoa(len(binary)) + " " + string(binary)))
+	}
+	d.written()
+	return nil
+}
+
+// Close stops any retrying first, so that it does not wait for a destination
+// that is down, then makes a last attempt at writing the pending messages.
+func (d *drainer) Close() error {
+	if d.closed.Swap(true) {
+		return nil
+	}
+	close(d.done)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := d.tryFlush()
+	if d.conn != nil {
+		d.closeConnection()
+	}
+	d.state.release()
+	return err
+}
+
+// failOver makes the drainer write every batch once, as it is part of a
+// failover group.
+func (d *drainer) failOver(handOver func(messages []Message)) {
+	d.handOver = handOver
+}
+
+func (d *drainer) flushPending() {
+	d.lock.Lock()
+	d.flushScheduled = false
+	var err error
+	if !d.closed.Load() {
+		err = d.flush()
+	}
+	if errors.Is(err, ErrUnavailable) {
+		// try again later rather than leave the messages pending until the
+		// next one is drained
+		d.flushScheduled = true
+		time.AfterFunc(d.flushInterval, d.flushPending)
+	}
+	d.lock.Unlock()
+
+	// handed over without the lock, as the group may drain to this drainer
+	// again
+	if unsent := Unsent(err); len(unsent) > 0 && d.handOver != nil {
+		d.handOver(unsent)
+	} else if err != nil {
+		d.errorLogger.Printf("Error flushing: %s \n", err.Error())
+	}
+}
+
+// buffer appends a framed message to the pending ones. Datagrams need no
+// framing. It must be called with the lock held.
+func (d *drainer) buffer(binary []byte) {
+	d.pendingCount++
+	if d.transport == "udp" {
+		d.pending = append(d.pending, binary...)
+		return
+	}
+
+	switch d.framing {
+	case FramingNonTransparent:
+		d.pending = append(d.pending, binary...)
+		d.pending = append(d.pending, '\n')
+	default:
+		d.pending = strconv.AppendInt(d.pending, int64(len(binary)), 10)
+		d.pending = append(d.pending, ' ')
+		d.pending = append(d.pending, binary...)
+	}
+}
+
+// flush writes the pending messages, reconnecting until it succeeds or the
+// drainer is closed, or gives up with ErrUnavailable if it is spooled. In a
+// failover group it makes a single attempt instead.
+// It must be called with the lock held.
+func (d *drainer) flush() error {
+	if d.handOver != nil {
+		return d.tryFlush()
+	}
+	defer d.resetAttempts()
+
+	for len(d.pending) > 0 {
+		if err := d.ensureConnection(); err != nil {
+			return err
+		}
+		err := d.conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
+		if err != nil {
+			return err
 		}
-		if err == nil {
+		if d.write(d.pending) == nil {
+			d.written()
 			return nil
 		}
-		d.errorLogger.Printf("Error writing: %s \n", err.Error())
-		d.conn.Close()
-		d.conn = nil
-		time.Sleep(time.Second)
+		if !d.sleep(time.Second) {
+			return ErrClosed
+		}
 	}
+	return nil
 }
 
-func (d *drainer) formatMessage(line string, tag string) ([]byte, error) {
-	var structuredDatas []rfc5424.StructuredData
-	if d.structuredData.ID != "" {
-		structuredDatas = append(structuredDatas, d.structuredData)
+// sleep waits for duration, returning false early if the drainer is closed
+// meanwhile.
+func (d *drainer) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-d.done:
+		return false
 	}
-	m := rfc5424.Message{
-		Priority:       rfc5424.User | rfc5424.Info,
-		Timestamp:      time.Now(),
-		UseUTC:         true,
-		Hostname:       d.hostname,
-		AppName:        tag,
-		ProcessID:      "rs2",
-		Message:        []byte(line),
-		StructuredData: structuredDatas,
+}
+
+// tryFlush makes a single attempt at writing the pending messages, which are
+// returned in an UnsentError if it fails. It must be called with the lock
+// held.
+func (d *drainer) tryFlush() error {
+	if len(d.pending) > 0 {
+		if err := d.writeOnce(); err != nil {
+			unsent := d.unsent
+			d.clearPending()
+			if len(unsent) > 0 {
+				return &UnsentError{Messages: unsent, Err: err}
+			}
+			return err
+		}
+	}
+	d.written()
+	return nil
+}
+
+// writeOnce makes a single attempt at writing the pending messages. It must
+// be called with the lock held.
+func (d *drainer) writeOnce() error {
+	if err := d.dial(); err != nil {
+		return err
+	}
+	if err := d.conn.SetWriteDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		return err
 	}
+	return d.write(d.pending)
+}
+
+// written acknowledges the messages that were written, or that need not be.
+// It must be called with the lock held.
+func (d *drainer) written() {
+	sent(d.unsent)
+	d.clearPending()
+}
+
+// withdraw drops what was buffered after pending bytes, pendingCount
+// messages and unsent messages. It must be called with the lock held.
+func (d *drainer) withdraw(pending, pendingCount, unsent int) {
+	d.pending = d.pending[:pending]
+	d.pendingCount = pendingCount
+	d.unsent = d.unsent[:unsent]
+}
+
+// clearPending must be called with the lock held.
+func (d *drainer) clearPending() {
+	d.pending = d.pending[:0]
+	d.pendingCount = 0
+	d.unsent = nil
+}
 
-	binary, err := m.MarshalBinary()
+// write writes the pending messages. It must be called with the lock held.
+func (d *drainer) write(binary []byte) error {
+	_, err := d.conn.Write(binary)
+	if err != nil {
+		sendErrors.Inc(d.address)
+		d.state.failed(err)
+		d.errorLogger.Printf("Error writing: %s \n", err.Error())
+		d.closeConnection()
+		return err
+	}
+	d.state.succeeded()
+	messagesSent.Add(float64(d.pendingCount), d.address)
+	bytesSent.Add(float64(len(binary)), d.address)
+	return nil
+}
+
+// formatMessage returns the messages to send for message, which are several
+// or none if it is too large and the oversize policy says so.
+func (d *drainer) formatMessage(message Message) ([][]byte, error) {
+	binary, err := d.marshal(message, nil)
 	if err != nil {
-		d.errorLogger.Printf("Error marshalling syslog: %s \n", err.Error())
 		return nil, err
 	}
-	if len(binary) > d.maxMessageSize {
-		binary = binary[:d.maxMessageSize]
+	if len(binary) <= d.maxMessageSize {
+		return [][]byte{binary}, nil
+	}
+
+	policy := d.oversizePolicy
+	if policy == "" {
+		policy = OversizePolicyTruncate
+	}
+	oversizeMessages.Inc(d.address, policy)
+
+	switch policy {
+	case OversizePolicyDrop:
+		d.dropped++
+		droppedMessages.Inc(d.address)
+		d.errorLogger.Printf("Dropped a message of %d bytes from %s as it is larger than %d bytes, %d dropped so far\n", len(binary), message.Path, d.maxMessageSize, d.dropped)
+		return nil, nil
+	case OversizePolicySplit:
+		return d.split(message)
+	default:
+		return [][]byte{truncate(binary, d.maxMessageSize)}, nil
+	}
+}
+
+// marshal formats a single message, adding the extra structured data if the
+// format has any.
+func (d *drainer) marshal(message Message, extra *rfc5424.StructuredData) ([]byte, error) {
+	timestamp := message.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	var binary []byte
+	if d.format == FormatRFC3164 {
+		binary = formatRFC3164(message, d.hostname, timestamp)
+	} else {
+		var structuredDatas []rfc5424.StructuredData
+		if message.StructuredData.ID != "" {
+			structuredDatas = append(structuredDatas, message.StructuredData)
+		} else if d.structuredData.ID != "" {
+			structuredDatas = append(structuredDatas, d.structuredData)
+		}
+		if extra != nil {
+			structuredDatas = append(structuredDatas, *extra)
+		}
+		m := rfc5424.Message{
+			Priority:       message.Priority,
+			Timestamp:      timestamp,
+			UseUTC:         true,
+			Hostname:       d.hostname,
+			AppName:        message.Tag,
+			ProcessID:      processID,
+			Message:        []byte(message.Line),
+			StructuredData: structuredDatas,
+		}
+
+		var err error
+		binary, err = m.MarshalBinary()
+		if err != nil {
+			d.errorLogger.Printf("Error marshalling syslog: %s \n", err.Error())
+			return nil, err
+		}
+	}
+	if d.escapesNewlines() {
+		// a newline ends the message, so escape the ones inside it the way
+		// rsyslog escapes control characters
+		binary = bytes.ReplaceAll(binary, []byte("\n"), []byte(escapedNewline))
 	}
 	return binary, nil
 }
 
+func (d *drainer) escapesNewlines() bool {
+	return d.framing == FramingNonTransparent && d.transport != "udp"
+}
+
 func (d *drainer) resetAttempts() {
 	d.connAttempts = 0
 	d.sleepSeconds = 1
@@ -174,18 +650,92 @@ func (d *drainer) incrementAttempts() {
 	}
 }
 
-func (d *drainer) ensureConnection() {
+func (d *drainer) ensureConnection() error {
+	d.dropClosedConnection()
 	for d.conn == nil {
 		d.incrementAttempts()
+		connectionAttempts.Inc(d.address)
 		conn, err := d.dialFunction()
 		if err != nil {
+			connectionErrors.Inc(d.address)
+			d.state.failed(err)
 			if d.maxRetries > 0 && d.connAttempts > d.maxRetries {
+				if d.spooled {
+					return fmt.Errorf("%w: %d attempts to connect failed: %s", ErrUnavailable, d.connAttempts, err)
+				}
 				d.errorLogger.Fatalln("Failed to connect to syslog server. Exiting now.")
 			}
 			d.errorLogger.Printf("Error connecting on attempt %d: %s. Will retry in %d seconds.\n", d.connAttempts, err.Error(), d.sleepSeconds)
-			time.Sleep(time.Second * time.Duration(d.sleepSeconds))
+			if !d.sleep(time.Second * time.Duration(d.sleepSeconds)) {
+				return ErrClosed
+			}
 		} else if conn != nil {
-			d.conn = conn
+			d.setConnection(conn)
 		}
 	}
+	return nil
+}
+
+func (d *drainer) connect() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.dial()
+}
+
+// dial must be called with the lock held.
+func (d *drainer) dial() error {
+	d.dropClosedConnection()
+	if d.conn != nil {
+		return nil
+	}
+	connectionAttempts.Inc(d.address)
+	conn, err := d.dialFunction()
+	if err != nil {
+		connectionErrors.Inc(d.address)
+		d.state.failed(err)
+		return err
+	}
+	d.setConnection(conn)
+	return nil
+}
+
+// setConnection must be called with the lock held. Syslog servers never send
+// anything back, so for stream transports a read returning means the server
+// closed the connection. Noticing this before writing keeps a batch from
+// being written into a connection that is already gone.
+func (d *drainer) setConnection(conn net.Conn) {
+	d.state.connected()
+	d.conn = conn
+	d.connClosed = nil
+	if d.transport == "udp" {
+		return
+	}
+
+	closed := make(chan struct{})
+	d.connClosed = closed
+	go func() {
+		io.Copy(io.Discard, conn) //nolint:errcheck
+		close(closed)
+	}()
+}
+
+// closeConnection must be called with the lock held.
+func (d *drainer) closeConnection() {
+	d.conn.Close()
+	d.conn = nil
+	d.state.disconnected()
+}
+
+// dropClosedConnection must be called with the lock held.
+func (d *drainer) dropClosedConnection() {
+	if d.conn == nil || d.connClosed == nil {
+		return
+	}
+	select {
+	case <-d.connClosed:
+		d.errorLogger.Println("Connection closed by syslog server")
+		d.closeConnection()
+	default:
+	}
 }
@@ -0,0 +1,289 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+const (
+	ModeFanOut   = "fan_out"
+	ModeFailover = "failover"
+)
+
+// destination is a single destination a failover group can switch between.
+type destination interface {
+	Drainer
+	// failOver makes the destination give up on messages it fails to send
+	// rather than retry them. Drain returns them in an UnsentError, and
+	// those of a batch written in the background are passed to handOver.
+	failOver(handOver func(messages []Message))
+	address() string
+}
+
+// prober is implemented by destinations that can tell whether they are
+// reachable without sending messages, as the primary of a failover group
+// must.
+type prober interface {
+	connect() error
+}
+
+// NewDestination returns a Drainer for a single destination: a pool of
+// connections to a syslog server, an HTTP endpoint or a local sink of JSON
+// lines.
+func NewDestination(errorLogger *log.Logger, drain Drain, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int) (Drainer, error) {
+	return newDestination(errorLogger, drain, hostname, structuredData, maxMessageSize)
+}
+
+func newDestination(errorLogger *log.Logger, drain Drain, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int) (destination, error) {
+	if IsLocalTransport(drain.Transport) {
+		return NewJSONSink(drain, hostname, structuredData)
+	}
+	if drain.Transport == TransportHTTP {
+		return NewHTTPSink(errorLogger, drain, hostname, structuredData)
+	}
+	return NewPool(errorLogger, drain, hostname, structuredData, maxMessageSize)
+}
+
+type fanOut struct {
+	drainers []Drainer
+}
+
+// NewFanOut returns a Drainer that sends every message to all drainers.
+func NewFanOut(drainers ...Drainer) *fanOut {
+	return &fanOut{drainers: drainers}
+}
+
+// Drain sends message to every drainer, and tells it was sent once all of
+// them did.
+func (f *fanOut) Drain(message Message) error {
+	errs := make([]error, len(f.drainers))
+
+	if message.Sent != nil {
+		var remaining atomic.Int64
+		remaining.Store(int64(len(f.drainers)))
+		allSent := message.Sent
+		message.Sent = func() {
+			if remaining.Add(-1) == 0 {
+				allSent()
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, drainer := range f.drainers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = drainer.Drain(message)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (f *fanOut) Flush() error {
+	var errs []error
+	for _, drainer := range f.drainers {
+		errs = append(errs, Flush(drainer))
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fanOut) Close() error {
+	var errs []error
+	for _, drainer := range f.drainers {
+		errs = append(errs, Close(drainer))
+	}
+	return errors.Join(errs...)
+}
+
+type failover struct {
+	errorLogger        *log.Logger
+	drainers           []destination
+	primary            prober
+	primaryCheckPeriod time.Duration
+	closed             atomic.Bool
+	done               chan struct{}
+
+	lock   sync.Mutex
+	active int
+}
+
+// NewFailover returns a Drainer that sends messages to the first of drains
+// that accepts them. While a backup is in use, the primary is checked every
+// primaryCheckPeriod and used again once it can be connected to.
+func NewFailover(errorLogger *log.Logger, drains []Drain, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int, primaryCheckPeriod time.Duration) (*failover, error) {
+	f := &failover{
+		errorLogger:        errorLogger,
+		primaryCheckPeriod: primaryCheckPeriod,
+		done:               make(chan struct{}),
+	}
+
+	for i, drain := range drains {
+		destination, err := newDestination(errorLogger, drain, hostname, structuredData, maxMessageSize)
+		if err != nil {
+			f.Close() //nolint:errcheck
+			return nil, err
+		}
+		destination.failOver(func(messages []Message) {
+			f.handOver(i, messages)
+		})
+		f.drainers = append(f.drainers, destination)
+	}
+
+	primary, ok := f.drainers[0].(prober)
+	if !ok {
+		f.Close() //nolint:errcheck
+		return nil, fmt.Errorf("the %s transport cannot be the primary of a failover group", drains[0].Transport)
+	}
+	f.primary = primary
+
+	go f.checkPrimary()
+
+	return f, nil
+}
+
+// Drain sends message to the destination in use. If that destination fails
+// to send it, or messages it held back, they are sent to the next one, which
+// is used from then on.
+func (f *failover) Drain(message Message) error {
+	return f.send([]Message{message})
+}
+
+// send drains messages to the destination in use, moving on to the next one
+// with the messages left whenever one fails, and waiting a second each time
+// all of them failed.
+func (f *failover) send(messages []Message) error {
+	for failures := 0; ; failures++ {
+		if f.closed.Load() {
+			return ErrClosed
+		}
+		if failures > 0 && failures%len(f.drainers) == 0 {
+			f.errorLogger.Println("All syslog destinations are unavailable. Will retry in 1 seconds.")
+			select {
+			case <-time.After(time.Second):
+			case <-f.done:
+				return ErrClosed
+			}
+		}
+
+		index := f.current()
+		var err error
+		messages, err = drainAll(f.drainers[index], messages)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrClosed) {
+			return err
+		}
+		f.errorLogger.Printf("Error sending to syslog destination %s: %s\n", f.drainers[index].address(), err)
+		f.switchFrom(index)
+	}
+}
+
+// drainAll drains messages to destination until it fails, and then returns
+// the messages it did not take, including those it held back.
+func drainAll(destination Drainer, messages []Message) ([]Message, error) {
+	for i, message := range messages {
+		err := destination.Drain(message)
+		if err == nil {
+			continue
+		}
+		unsent := Unsent(err)
+		if len(unsent) == 0 {
+			unsent = []Message{message}
+		}
+		return append(unsent, messages[i+1:]...), err
+	}
+	return nil, nil
+}
+
+// handOver sends the messages the destination at index failed to send in
+// the background to the next destinations.
+func (f *failover) handOver(index int, messages []Message) {
+	f.errorLogger.Printf("Error sending %d messages to syslog destination %s\n", len(messages), f.drainers[index].address())
+	f.switchFrom(index)
+	if err := f.send(messages); err != nil {
+		f.errorLogger.Printf("could not send messages held back for syslog destination %s: %s\n", f.drainers[index].address(), err)
+	}
+}
+
+func (f *failover) current() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.active
+}
+
+// switchFrom moves on from the destination at index to the next one, unless
+// the group already did.
+func (f *failover) switchFrom(index int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.active != index {
+		return
+	}
+	f.active = (index + 1) % len(f.drainers)
+	f.errorLogger.Printf("Switched to syslog destination %s\n", f.drainers[f.active].address())
+}
+
+// checkPrimary connects to the primary every primaryCheckPeriod while a
+// backup is in use, and switches back to it once that succeeds. It runs in
+// the background, so that a primary that is slow to connect to does not hold
+// up sending messages.
+func (f *failover) checkPrimary() {
+	ticker := time.NewTicker(f.primaryCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+
+		if f.current() == 0 || f.primary.connect() != nil {
+			continue
+		}
+
+		f.lock.Lock()
+		if f.active != 0 {
+			f.errorLogger.Println("Primary syslog destination is reachable again, switching back to it")
+			f.active = 0
+		}
+		f.lock.Unlock()
+	}
+}
+
+// address returns the address of the primary, which labels the metrics of
+// the group as a whole.
+func (f *failover) address() string {
+	return f.drainers[0].address()
+}
+
+func (f *failover) Flush() error {
+	return Flush(f.drainers[f.current()])
+}
+
+// Close closes every destination of the group, which stops Drain from
+// retrying them.
+func (f *failover) Close() error {
+	if f.closed.Swap(true) {
+		return nil
+	}
+	close(f.done)
+
+	var errs []error
+	for _, drainer := range f.drainers {
+		errs = append(errs, Close(drainer))
+	}
+	return errors.Join(errs...)
+}
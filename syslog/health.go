@@ -0,0 +1,113 @@
+package syslog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DestinationStatus describes how sending to a destination went lately.
+type DestinationStatus struct {
+	Destination string    `json:"destination"`
+	Connections int       `json:"connections"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+}
+
+// Healthy tells whether the destination either sent successfully within
+// window or has not failed since it last did. A destination that is merely
+// idle stays healthy.
+func (s DestinationStatus) Healthy(window time.Duration, now time.Time) bool {
+	if s.LastErrorAt.IsZero() || s.LastSuccess.After(s.LastErrorAt) {
+		return true
+	}
+	return !s.LastSuccess.IsZero() && now.Sub(s.LastSuccess) <= window
+}
+
+type destinationState struct {
+	lock   sync.Mutex
+	status DestinationStatus
+
+	// users is guarded by destinationsLock.
+	users int
+}
+
+var (
+	destinationsLock sync.Mutex
+	destinations     = map[string]*destinationState{}
+)
+
+// trackDestination returns the state shared by everything sending to the
+// destination. Each caller releases it once it stops sending.
+func trackDestination(destination string) *destinationState {
+	destinationsLock.Lock()
+	defer destinationsLock.Unlock()
+
+	state, found := destinations[destination]
+	if !found {
+		state = &destinationState{status: DestinationStatus{Destination: destination}}
+		destinations[destination] = state
+	}
+	state.users++
+	return state
+}
+
+// release forgets the destination once nothing sends to it anymore, so that a
+// destination removed from the configuration no longer affects health checks.
+func (s *destinationState) release() {
+	destinationsLock.Lock()
+	defer destinationsLock.Unlock()
+
+	s.users--
+	if s.users == 0 {
+		delete(destinations, s.status.Destination)
+	}
+}
+
+// DestinationStatuses returns the status of every destination, sorted by
+// destination.
+func DestinationStatuses() []DestinationStatus {
+	destinationsLock.Lock()
+	defer destinationsLock.Unlock()
+
+	statuses := make([]DestinationStatus, 0, len(destinations))
+	for _, state := range destinations {
+		state.lock.Lock()
+		statuses = append(statuses, state.status)
+		state.lock.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Destination < statuses[j].Destination
+	})
+	return statuses
+}
+
+func (s *destinationState) succeeded() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.LastSuccess = time.Now()
+}
+
+func (s *destinationState) failed(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.LastError = err.Error()
+	s.status.LastErrorAt = time.Now()
+}
+
+func (s *destinationState) connected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.Connections++
+}
+
+func (s *destinationState) disconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.Connections--
+}
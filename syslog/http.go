@@ -0,0 +1,418 @@
+package syslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+const (
+	TransportHTTP = "http"
+
+	HTTPBodyNDJSON    = "ndjson"
+	HTTPBodyJSONArray = "json_array"
+
+	defaultHTTPBatchSize     = 1024 * 1024
+	defaultHTTPFlushInterval = time.Second
+	maxHTTPBackoff           = 60 * time.Second
+)
+
+// HTTPConfig configures the http transport, which POSTs batches of JSON
+// lines to the URL in the address of the destination.
+type HTTPConfig struct {
+	Headers         map[string]string `yaml:"headers"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	Body            string            `yaml:"body"`
+	Gzip            bool              `yaml:"gzip"`
+}
+
+// httpSink is a Drainer that collects messages and POSTs them as JSON once
+// batchSize bytes are pending or flushInterval has passed since the first of
+// them. Requests failing with a 5xx or 429 status are retried with backoff.
+type httpSink struct {
+	errorLogger    *log.Logger
+	client         *http.Client
+	url            string
+	config         HTTPConfig
+	hostname       string
+	structuredData map[string]map[string]string
+	batchSize      int
+	flushInterval  time.Duration
+	maxRetries     int
+	spooled        bool
+	state          *destinationState
+	closed         atomic.Bool
+	done           chan struct{}
+
+	lock           sync.Mutex
+	pending        [][]byte
+	pendingSize    int
+	unsent         []Message
+	flushScheduled bool
+	handOver       func(messages []Message)
+}
+
+// retryableError is a failure that may go away when the request is sent again.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func NewHTTPSink(errorLogger *log.Logger, drain Drain, hostname string, structuredData rfc5424.StructuredData) (*httpSink, error) {
+	if drain.Address == "" {
+		return nil, fmt.Errorf("the %s transport requires a URL as address", TransportHTTP)
+	}
+	switch drain.HTTP.Body {
+	case "", HTTPBodyNDJSON, HTTPBodyJSONArray:
+	default:
+		return nil, fmt.Errorf("unknown http body: %q", drain.HTTP.Body)
+	}
+
+	tlsConf, err := generateTLSConfig(drain, errorLogger)
+	if err != nil {
+		errorLogger.Println("Error generating TLS config: ", err)
+		return nil, err
+	}
+
+	batchSize := drain.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultHTTPBatchSize
+	}
+	flushInterval := drain.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultHTTPFlushInterval
+	}
+
+	return &httpSink{
+		errorLogger: errorLogger,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConf,
+			},
+		},
+		url:            drain.Address,
+		config:         drain.HTTP,
+		hostname:       hostname,
+		structuredData: jsonStructuredData(structuredData),
+		batchSize:      batchSize,
+		flushInterval:  flushInterval,
+		maxRetries:     drain.MaxRetries,
+		spooled:        drain.Spool.Dir != "",
+		state:          trackDestination(drain.Address),
+		done:           make(chan struct{}),
+	}, nil
+}
+
+func (s *httpSink) Drain(message Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	start, startSize := len(s.pending), s.pendingSize
+	if err := s.buffer(message); err != nil {
+		return err
+	}
+
+	if s.pendingSize >= s.batchSize {
+		err := s.flush()
+		if err != nil && s.handOver == nil {
+			// leave the message to the caller to drain again, so that it is
+			// not sent twice
+			s.withdraw(start, startSize)
+		}
+		return err
+	}
+	if !s.flushScheduled {
+		s.flushScheduled = true
+		time.AfterFunc(s.flushInterval, s.flushPending)
+	}
+	return nil
+}
+
+// Flush makes a single attempt at sending the pending messages, which are
+// kept for the next attempt if it fails.
+func (s *httpSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if err := s.post(); err != nil {
+		return err
+	}
+	s.sent()
+	return nil
+}
+
+// Close stops any retrying, then makes a last attempt at sending the pending
+// messages.
+func (s *httpSink) Close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	close(s.done)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.release()
+	return s.tryFlush()
+}
+
+// failOver makes the sink send every batch once, as it is part of a failover
+// group.
+func (s *httpSink) failOver(handOver func(messages []Message)) {
+	s.handOver = handOver
+}
+
+// connect tells whether the endpoint is reachable by sending it a HEAD
+// request. Any response but a server error will do, as the endpoint need not
+// support HEAD.
+func (s *httpSink) connect() error {
+	request, err := http.NewRequest(http.MethodHead, s.url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) address() string {
+	return s.url
+}
+
+func (s *httpSink) flushPending() {
+	s.lock.Lock()
+	s.flushScheduled = false
+	var err error
+	if !s.closed.Load() {
+		err = s.flush()
+	}
+	if errors.Is(err, ErrUnavailable) {
+		// try again later rather than leave the messages pending until the
+		// next one is drained
+		s.flushScheduled = true
+		time.AfterFunc(s.flushInterval, s.flushPending)
+	}
+	s.lock.Unlock()
+
+	// handed over without the lock, as the group may drain to this sink again
+	if unsent := Unsent(err); len(unsent) > 0 && s.handOver != nil {
+		s.handOver(unsent)
+	}
+}
+
+// buffer must be called with the lock held.
+func (s *httpSink) buffer(message Message) error {
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	line, err := marshalJSONLine(message, s.hostname, s.structuredData)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, line)
+	s.pendingSize += len(line) + 1
+	s.unsent = append(s.unsent, message)
+	return nil
+}
+
+// flush sends the pending messages, retrying with backoff while the endpoint
+// fails in a way that may go away. Batches the endpoint rejects are dropped.
+// If the sink is closed while retrying, the messages are left for Close to
+// send. If it gives up while spooled, they are left for a later flush. In a failover group it makes a single attempt instead. It must be
+// called with the lock held.
+func (s *httpSink) flush() error {
+	if s.handOver != nil {
+		return s.tryFlush()
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.post()
+		if err == nil {
+			s.sent()
+			return nil
+		}
+
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			s.drop(err)
+			return nil
+		}
+		if s.maxRetries > 0 && attempt > s.maxRetries {
+			if s.spooled {
+				return fmt.Errorf("%w: %d attempts to send failed: %s", ErrUnavailable, attempt, err)
+			}
+			s.errorLogger.Fatalln("Failed to send to HTTP endpoint. Exiting now.")
+		}
+
+		wait := backoff
+		if retryable.retryAfter > 0 {
+			wait = retryable.retryAfter
+		}
+		s.errorLogger.Printf("Error sending to %s on attempt %d: %s. Will retry in %d seconds.\n", s.url, attempt, err, int(wait.Seconds()))
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return ErrClosed
+		}
+
+		backoff = min(backoff*2, maxHTTPBackoff)
+	}
+}
+
+// tryFlush makes a single attempt at sending the pending messages, which are
+// returned in an UnsentError if it fails in a way that may go away. Batches
+// the endpoint rejects are dropped. It must be called with the lock held.
+func (s *httpSink) tryFlush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.post()
+	if _, ok := err.(*retryableError); ok {
+		unsent := s.unsent
+		s.reset()
+		return &UnsentError{Messages: unsent, Err: err}
+	}
+	if err != nil {
+		s.drop(err)
+		return nil
+	}
+	s.sent()
+	return nil
+}
+
+// drop gives up on the pending messages, which the endpoint rejected. It
+// must be called with the lock held.
+func (s *httpSink) drop(err error) {
+	s.errorLogger.Printf("Dropping %d messages rejected by %s: %s\n", len(s.pending), s.url, err)
+	droppedMessages.Add(float64(len(s.pending)), s.url)
+	s.sent()
+}
+
+// sent acknowledges the pending messages once they were sent or dropped for
+// good. It must be called with the lock held.
+func (s *httpSink) sent() {
+	sent(s.unsent)
+	s.reset()
+}
+
+// withdraw drops the messages buffered after the first pending ones, which
+// were size bytes. It must be called with the lock held.
+func (s *httpSink) withdraw(pending, size int) {
+	s.pending = s.pending[:pending]
+	s.pendingSize = size
+	s.unsent = s.unsent[:pending]
+}
+
+// reset must be called with the lock held.
+func (s *httpSink) reset() {
+	s.pending = s.pending[:0]
+	s.pendingSize = 0
+	s.unsent = nil
+}
+
+// post must be called with the lock held.
+func (s *httpSink) post() error {
+	body, contentType := s.body()
+
+	var encoding string
+	if s.config.Gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+		encoding = "gzip"
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	for name, value := range s.config.Headers {
+		request.Header.Set(name, value)
+	}
+	if s.config.BearerTokenFile != "" {
+		// read on every request, so that a renewed token is picked up
+		token, err := os.ReadFile(s.config.BearerTokenFile)
+		if err != nil {
+			return &retryableError{err: fmt.Errorf("error reading bearer token: %w", err)}
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		sendErrors.Inc(s.url)
+		s.state.failed(err)
+		return &retryableError{err: err}
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body) //nolint:errcheck
+
+	if response.StatusCode/100 == 2 {
+		s.state.succeeded()
+		messagesSent.Add(float64(len(s.pending)), s.url)
+		bytesSent.Add(float64(len(body)), s.url)
+		return nil
+	}
+	sendErrors.Inc(s.url)
+
+	err = fmt.Errorf("unexpected status: %s", response.Status)
+	s.state.failed(err)
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return &retryableError{err: err, retryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	return err
+}
+
+// body must be called with the lock held.
+func (s *httpSink) body() ([]byte, string) {
+	if s.config.Body == HTTPBodyJSONArray {
+		return append(append([]byte{'['}, bytes.Join(s.pending, []byte{','})...), ']'), "application/json"
+	}
+	return append(bytes.Join(s.pending, []byte{'\n'}), '\n'), "application/x-ndjson"
+}
@@ -0,0 +1,13 @@
+package syslog
+
+import "code.cloudfoundry.org/blackbox/metrics"
+
+var (
+	messagesSent       = metrics.NewCounter("blackbox_messages_sent_total", "Messages sent to a destination.", "destination")
+	bytesSent          = metrics.NewCounter("blackbox_bytes_sent_total", "Bytes sent to a destination.", "destination")
+	sendErrors         = metrics.NewCounter("blackbox_send_errors_total", "Failed attempts at sending messages to a destination.", "destination")
+	connectionAttempts = metrics.NewCounter("blackbox_connection_attempts_total", "Attempts at connecting to a destination.", "destination")
+	connectionErrors   = metrics.NewCounter("blackbox_connection_errors_total", "Failed attempts at connecting to a destination.", "destination")
+	droppedMessages    = metrics.NewCounter("blackbox_dropped_messages_total", "Messages given up on without sending them to a destination.", "destination")
+	oversizeMessages   = metrics.NewCounter("blackbox_oversize_messages_total", "Messages larger than the max message size of a destination, by the policy applied to them.", "destination", "policy")
+)
@@ -0,0 +1,135 @@
+package syslog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"unicode/utf8"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+const (
+	OversizePolicyTruncate = "truncate"
+	OversizePolicySplit    = "split"
+	OversizePolicyDrop     = "drop"
+
+	truncationMarker = "[truncated]"
+	escapedNewline   = "#012"
+
+	// splitStructuredDataID links the parts of a split message. 47450 is the
+	// private enterprise number loggregator uses for its structured data.
+	splitStructuredDataID = "split@47450"
+	// minSplitSize is the least room for the line in each part below which a
+	// message is truncated rather than split into a great many parts.
+	minSplitSize = 64
+)
+
+// MaxMessageSizeFor returns the largest message that can be sent to a
+// destination: maxMessageSize, unless its transport or format only allow
+// smaller ones.
+func MaxMessageSizeFor(drain Drain, maxMessageSize int) int {
+	if drain.Transport == "udp" && maxMessageSize > maxUDPMessageSize {
+		maxMessageSize = maxUDPMessageSize
+	}
+	if drain.Format == FormatRFC3164 && maxMessageSize > maxRFC3164MessageSize {
+		maxMessageSize = maxRFC3164MessageSize
+	}
+	return maxMessageSize
+}
+
+// truncate cuts binary to size bytes on a rune boundary, ending it with a
+// marker so that the cut is noticed.
+func truncate(binary []byte, size int) []byte {
+	if size <= len(truncationMarker) {
+		return binary[:runeBoundary(binary, size)]
+	}
+	cut := runeBoundary(binary, size-len(truncationMarker))
+	return append(binary[:cut:cut], truncationMarker...)
+}
+
+// runeBoundary returns the largest index not above n that does not split a
+// rune of b.
+func runeBoundary(b []byte, n int) int {
+	for n > 0 && n < len(b) && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return n
+}
+
+// split sends the line of message over several messages that each fit, with
+// structured data giving the parts a common id, their number and the total.
+// Formats without structured data get the parts in order but not linked.
+func (d *drainer) split(message Message) ([][]byte, error) {
+	id := splitID()
+
+	empty := message
+	empty.Line = ""
+	overhead, err := d.marshal(empty, splitStructuredData(id, 9999, 9999))
+	if err != nil {
+		return nil, err
+	}
+	room := d.maxMessageSize - len(overhead)
+	if room < minSplitSize {
+		binary, err := d.marshal(message, nil)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{truncate(binary, d.maxMessageSize)}, nil
+	}
+
+	chunks := d.splitLine(message.Line, room)
+	parts := make([][]byte, 0, len(chunks))
+	for i, chunk := range chunks {
+		part := message
+		part.Line = chunk
+		binary, err := d.marshal(part, splitStructuredData(id, i+1, len(chunks)))
+		if err != nil {
+			return nil, err
+		}
+		if len(binary) > d.maxMessageSize {
+			binary = truncate(binary, d.maxMessageSize)
+		}
+		parts = append(parts, binary)
+	}
+	return parts, nil
+}
+
+// splitLine cuts line into chunks taking at most size bytes once formatted,
+// without splitting runes or escaped newlines.
+func (d *drainer) splitLine(line string, size int) []string {
+	var chunks []string
+	start, width := 0, 0
+	for i, r := range line {
+		runeWidth := utf8.RuneLen(r)
+		if r == utf8.RuneError {
+			runeWidth = 1
+		}
+		if r == '\n' && d.escapesNewlines() {
+			runeWidth = len(escapedNewline)
+		}
+		if width+runeWidth > size && i > start {
+			chunks = append(chunks, line[start:i])
+			start, width = i, 0
+		}
+		width += runeWidth
+	}
+	return append(chunks, line[start:])
+}
+
+func splitStructuredData(id string, part, total int) *rfc5424.StructuredData {
+	return &rfc5424.StructuredData{
+		ID: splitStructuredDataID,
+		Parameters: []rfc5424.SDParam{
+			{Name: "id", Value: id},
+			{Name: "part", Value: strconv.Itoa(part)},
+			{Name: "total", Value: strconv.Itoa(total)},
+		},
+	}
+}
+
+func splitID() string {
+	id := make([]byte, 8)
+	rand.Read(id) //nolint:errcheck
+	return hex.EncodeToString(id)
+}
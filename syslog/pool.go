@@ -0,0 +1,82 @@
+package syslog
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+// pool spreads messages over a fixed number of connections to the same
+// destination. All messages of a file use the same connection, so they stay
+// in order.
+type pool struct {
+	drainers []*drainer
+}
+
+func NewPool(errorLogger *log.Logger, drain Drain, hostname string, structuredData rfc5424.StructuredData, maxMessageSize int) (*pool, error) {
+	connections := drain.Connections
+	if connections < 1 {
+		connections = 1
+	}
+
+	if limit := MaxMessageSizeFor(drain, maxMessageSize); limit < maxMessageSize {
+		errorLogger.Printf("Messages to %s are limited to %d bytes rather than max_message_size of %d bytes\n", drain.Address, limit, maxMessageSize)
+	}
+
+	p := &pool{}
+	for range connections {
+		drainer, err := NewDrainer(errorLogger, drain, hostname, structuredData, maxMessageSize)
+		if err != nil {
+			return nil, err
+		}
+		p.drainers = append(p.drainers, drainer)
+	}
+
+	return p, nil
+}
+
+func (p *pool) Drain(message Message) error {
+	return p.drainerFor(message).Drain(message)
+}
+
+func (p *pool) Flush() error {
+	var errs []error
+	for _, drainer := range p.drainers {
+		errs = append(errs, drainer.Flush())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *pool) Close() error {
+	var errs []error
+	for _, drainer := range p.drainers {
+		errs = append(errs, drainer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *pool) failOver(handOver func(messages []Message)) {
+	for _, drainer := range p.drainers {
+		drainer.failOver(handOver)
+	}
+}
+
+func (p *pool) connect() error {
+	return p.drainers[0].connect()
+}
+
+func (p *pool) address() string {
+	return p.drainers[0].address
+}
+
+func (p *pool) drainerFor(message Message) *drainer {
+	if len(p.drainers) == 1 {
+		return p.drainers[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(message.Path))
+	return p.drainers[hash.Sum32()%uint32(len(p.drainers))]
+}
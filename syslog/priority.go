@@ -0,0 +1,75 @@
+package syslog
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+// facilities are listed by their numerical code rather than with the
+// rfc5424 constants, which skip codes 12 to 15 and so mislabel local0-7.
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var severities = map[string]rfc5424.Priority{
+	"emerg":     rfc5424.Emergency,
+	"emergency": rfc5424.Emergency,
+	"alert":     rfc5424.Alert,
+	"crit":      rfc5424.Crit,
+	"critical":  rfc5424.Crit,
+	"err":       rfc5424.Error,
+	"error":     rfc5424.Error,
+	"warning":   rfc5424.Warning,
+	"warn":      rfc5424.Warning,
+	"notice":    rfc5424.Notice,
+	"info":      rfc5424.Info,
+	"debug":     rfc5424.Debug,
+}
+
+// ParseFacility converts a syslog facility keyword such as "local0" into its
+// priority value.
+func ParseFacility(name string) (rfc5424.Priority, error) {
+	code, found := facilities[strings.ToLower(name)]
+	if !found {
+		return 0, fmt.Errorf("unknown syslog facility: %q", name)
+	}
+	return rfc5424.Priority(code << 3), nil
+}
+
+// ParseSeverity converts a syslog severity keyword such as "err" into its
+// priority value.
+func ParseSeverity(name string) (rfc5424.Priority, error) {
+	severity, found := severities[strings.ToLower(name)]
+	if !found {
+		return 0, fmt.Errorf("unknown syslog severity: %q", name)
+	}
+	return severity, nil
+}
+
+var severityNames = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// severityName returns the keyword of the severity of priority.
+func severityName(priority rfc5424.Priority) string {
+	return severityNames[priority&0x07]
+}
@@ -0,0 +1,68 @@
+package syslog
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatRFC5424 = "rfc5424"
+	FormatRFC3164 = "rfc3164"
+)
+
+const (
+	// MaxAppNameLength is the longest APP-NAME RFC 5424 allows.
+	MaxAppNameLength = 48
+	// maxTagLength is the longest TAG RFC 3164 allows.
+	maxTagLength = 32
+	// maxRFC3164MessageSize is the longest packet RFC 3164 allows.
+	maxRFC3164MessageSize = 1024
+)
+
+// formatRFC3164 formats a message the BSD way:
+//
+//	<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+//
+// The timestamp is in local time and has no year, as RFC 3164 has no way of
+// saying otherwise.
+func formatRFC3164(message Message, hostname string, timestamp time.Time) []byte {
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	var b []byte
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(message.Priority), 10)
+	b = append(b, '>')
+	b = timestamp.Local().AppendFormat(b, time.Stamp)
+	b = append(b, ' ')
+	b = append(b, hostname...)
+	b = append(b, ' ')
+	b = append(b, rfc3164Tag(message.Tag)...)
+	b = append(b, '[')
+	b = append(b, processID...)
+	b = append(b, "]: "...)
+	b = append(b, message.Line...)
+	return b
+}
+
+// rfc3164Tag adapts an app-name, which only has printable characters, to a
+// TAG: the characters that end a TAG are dropped and it is cut to 32
+// characters.
+func rfc3164Tag(appName string) string {
+	tag := strings.Map(func(r rune) rune {
+		if r == '[' || r == ']' || r == ':' {
+			return -1
+		}
+		return r
+	}, appName)
+
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	if tag == "" {
+		tag = "-"
+	}
+	return tag
+}
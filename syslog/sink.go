@@ -0,0 +1,230 @@
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
+)
+
+const (
+	TransportStdout = "stdout"
+	TransportFile   = "file"
+
+	defaultSinkFileMaxSize    = 64 * 1024 * 1024
+	defaultSinkFileMaxBackups = 5
+)
+
+// FileConfig configures the file written by the file transport. Once it grows
+// past MaxSize bytes it is rotated, keeping MaxBackups older files named
+// after it with the suffixes .1, .2 and so on.
+type FileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+type jsonLine struct {
+	Timestamp      string                       `json:"timestamp"`
+	Hostname       string                       `json:"hostname"`
+	Tag            string                       `json:"tag"`
+	Path           string                       `json:"path"`
+	Severity       string                       `json:"severity"`
+	Message        string                       `json:"message"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+}
+
+func jsonStructuredData(structuredData rfc5424.StructuredData) map[string]map[string]string {
+	if structuredData.ID == "" {
+		return nil
+	}
+
+	params := map[string]string{}
+	for _, param := range structuredData.Parameters {
+		params[param.Name] = param.Value
+	}
+	return map[string]map[string]string{structuredData.ID: params}
+}
+
+func marshalJSONLine(message Message, hostname string, structuredData map[string]map[string]string) ([]byte, error) {
+	timestamp := message.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if message.StructuredData.ID != "" {
+		structuredData = jsonStructuredData(message.StructuredData)
+	}
+
+	return json.Marshal(jsonLine{
+		Timestamp:      timestamp.UTC().Format(time.RFC3339Nano),
+		Hostname:       hostname,
+		Tag:            message.Tag,
+		Path:           message.Path,
+		Severity:       severityName(message.Priority),
+		Message:        message.Line,
+		StructuredData: structuredData,
+	})
+}
+
+// jsonSink is a Drainer that writes every message as a line of JSON, for
+// setups where something other than a syslog server ships the logs.
+type jsonSink struct {
+	hostname       string
+	structuredData map[string]map[string]string
+	name           string
+	state          *destinationState
+
+	lock       sync.Mutex
+	closed     bool
+	writer     io.Writer
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+// IsLocalTransport tells whether transport writes JSON lines locally rather
+// than sending syslog messages over the network.
+func IsLocalTransport(transport string) bool {
+	return transport == TransportStdout || transport == TransportFile
+}
+
+func NewJSONSink(drain Drain, hostname string, structuredData rfc5424.StructuredData) (*jsonSink, error) {
+	s := &jsonSink{
+		hostname: hostname,
+		name:     drain.Transport,
+	}
+
+	s.structuredData = jsonStructuredData(structuredData)
+
+	switch drain.Transport {
+	case TransportStdout:
+		s.writer = os.Stdout
+	case TransportFile:
+		if drain.File.Path == "" {
+			return nil, fmt.Errorf("the %s transport requires a path", TransportFile)
+		}
+		s.name = drain.File.Path
+		s.maxSize = drain.File.MaxSize
+		if s.maxSize <= 0 {
+			s.maxSize = defaultSinkFileMaxSize
+		}
+		s.maxBackups = drain.File.MaxBackups
+		if s.maxBackups <= 0 {
+			s.maxBackups = defaultSinkFileMaxBackups
+		}
+		if err := s.openFile(drain.File.Path); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown local transport: %q", drain.Transport)
+	}
+	s.state = trackDestination(s.name)
+
+	return s, nil
+}
+
+func (s *jsonSink) Drain(message Message) error {
+	line, err := marshalJSONLine(message, s.hostname, s.structuredData)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.file != nil && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		sendErrors.Inc(s.name)
+		s.state.failed(err)
+		return err
+	}
+	s.state.succeeded()
+	messagesSent.Inc(s.name)
+	bytesSent.Add(float64(n), s.name)
+	sent([]Message{message})
+	return nil
+}
+
+// Close closes the file written to. Standard output is left open.
+func (s *jsonSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.state.release()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// failOver and address let a sink be a backup in a failover group. A sink
+// holds nothing back, the messages it fails to write are returned by Drain.
+func (s *jsonSink) failOver(func(messages []Message)) {}
+
+func (s *jsonSink) address() string {
+	return s.name
+}
+
+// openFile must be called with the lock held, or before the sink is used.
+func (s *jsonSink) openFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.writer = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate must be called with the lock held.
+func (s *jsonSink) rotate() error {
+	path := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(backupPath(path, s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		os.Rename(backupPath(path, i), backupPath(path, i+1)) //nolint:errcheck
+	}
+	if err := os.Rename(path, backupPath(path, 1)); err != nil {
+		return err
+	}
+
+	return s.openFile(path)
+}
+
+func backupPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
@@ -0,0 +1,613 @@
+package syslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SpoolPolicyDropOldest = "drop_oldest"
+	SpoolPolicyBlock      = "block"
+
+	defaultSpoolMaxSize    = 64 * 1024 * 1024
+	maxSpoolSegmentSize    = 1024 * 1024
+	spoolSegmentPrefix     = "segment-"
+	spoolSegmentFileSuffix = ".spool"
+	spoolCursorFilename    = "cursor.json"
+
+	// spoolSyncInterval is how often the segment written to is synced and how
+	// far replay got is saved, which bounds how many messages are sent again
+	// after blackbox is killed.
+	spoolSyncInterval = time.Second
+
+	maxSpoolBackoff = 60 * time.Second
+)
+
+type SpoolConfig struct {
+	Dir     string `yaml:"dir"`
+	MaxSize int64  `yaml:"max_size"`
+	Policy  string `yaml:"policy"`
+}
+
+// spoolCursor is how far the messages replayed were delivered, saved so that
+// a spool using the same dir does not send them again.
+type spoolCursor struct {
+	Seq    int   `json:"seq"`
+	Offset int64 `json:"offset"`
+}
+
+type spoolSegment struct {
+	seq  int
+	path string
+	size int64
+}
+
+// spool is a Drainer that appends messages to segment files on disk and
+// replays them in order to the next Drainer, so that callers are not held up
+// while the destination is unavailable.
+type spool struct {
+	next        Drainer
+	address     string
+	errorLogger *log.Logger
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	policy      string
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	segments   []*spoolSegment
+	totalSize  int64
+	readOffset int64
+	writer     *os.File
+	closed     bool
+	done       chan struct{}
+	// unsynced are the messages written since the segment was last synced,
+	// which are acknowledged once it is.
+	unsynced []Message
+	// delivered is how far the next Drainer acknowledged the messages
+	// replayed, and replayed the segments read to their end whose messages
+	// were not all acknowledged yet.
+	delivered spoolCursor
+	replayed  []*spoolSegment
+
+	// cursorLock guards the cursor last saved, so that saves do not overtake
+	// each other.
+	cursorLock sync.Mutex
+	saved      spoolCursor
+}
+
+func NewSpool(errorLogger *log.Logger, config SpoolConfig, next Drainer) (*spool, error) {
+	s := &spool{
+		next:        next,
+		address:     addressOf(next),
+		errorLogger: errorLogger,
+		dir:         config.Dir,
+		maxSize:     config.MaxSize,
+		policy:      config.Policy,
+		done:        make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+
+	if s.maxSize == 0 {
+		s.maxSize = defaultSpoolMaxSize
+	}
+	if s.maxSize < 0 {
+		return nil, fmt.Errorf("spool max_size must not be negative: %d", s.maxSize)
+	}
+	s.segmentSize = min(s.maxSize/4, maxSpoolSegmentSize)
+
+	if s.policy == "" {
+		s.policy = SpoolPolicyDropOldest
+	}
+	if s.policy != SpoolPolicyDropOldest && s.policy != SpoolPolicyBlock {
+		return nil, fmt.Errorf("unknown spool policy: %q", s.policy)
+	}
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, err
+	}
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := s.loadCursor(); err != nil {
+		return nil, err
+	}
+	if err := s.openSegment(); err != nil {
+		return nil, err
+	}
+	s.delivered = spoolCursor{Seq: s.segments[0].seq, Offset: s.readOffset}
+
+	go s.replay()
+	go s.syncEvery(spoolSyncInterval)
+
+	return s, nil
+}
+
+func (s *spool) loadSegments() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, spoolSegmentPrefix) || !strings.HasSuffix(name, spoolSegmentFileSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentFileSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		s.segments = append(s.segments, &spoolSegment{
+			seq:  seq,
+			path: filepath.Join(s.dir, name),
+			size: info.Size(),
+		})
+		s.totalSize += info.Size()
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	return nil
+}
+
+// loadCursor removes the segments that were replayed before, and resumes
+// replaying the oldest one left from where the cursor says.
+func (s *spool) loadCursor() error {
+	contents, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cursor spoolCursor
+	if err := json.Unmarshal(contents, &cursor); err != nil {
+		s.errorLogger.Printf("Ignoring corrupt spool cursor: %s\n", err)
+		return nil
+	}
+	s.saved = cursor
+
+	for len(s.segments) > 0 && s.segments[0].seq < cursor.Seq {
+		s.removeOldestSegment()
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == cursor.Seq {
+		// the segment may not have been synced before blackbox stopped
+		s.readOffset = min(cursor.Offset, s.segments[0].size)
+	}
+	return nil
+}
+
+// saveCursor writes how far replay got to disk if it changed since it was
+// last saved.
+func (s *spool) saveCursor() error {
+	s.cursorLock.Lock()
+	defer s.cursorLock.Unlock()
+
+	s.lock.Lock()
+	cursor := s.delivered
+	s.lock.Unlock()
+	if cursor == s.saved {
+		return nil
+	}
+
+	contents, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(s.dir, spoolCursorFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(s.dir, spoolCursorFilename)); err != nil {
+		return err
+	}
+
+	s.saved = cursor
+	return nil
+}
+
+// sync syncs the segment written to, then acknowledges the messages written
+// to it, so that whatever they were read from is not read again before they
+// are on disk.
+func (s *spool) sync() error {
+	s.lock.Lock()
+	if s.closed || len(s.unsynced) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	if err := s.writer.Sync(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	unsynced := s.unsynced
+	s.unsynced = nil
+	s.lock.Unlock()
+
+	sent(unsynced)
+	return nil
+}
+
+func (s *spool) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.lock.Lock()
+		closed := s.closed
+		s.lock.Unlock()
+		if closed {
+			return
+		}
+
+		if err := s.sync(); err != nil {
+			s.errorLogger.Printf("Error syncing spool segment: %s\n", err)
+		}
+		if err := s.saveCursor(); err != nil {
+			s.errorLogger.Printf("Error saving spool cursor: %s\n", err)
+		}
+	}
+}
+
+// openSegment starts a new segment to write to. It must be called with the
+// lock held.
+func (s *spool) openSegment() error {
+	seq := 0
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%s%010d%s", spoolSegmentPrefix, seq, spoolSegmentFileSuffix))
+	writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600) // #nosec G304
+	if err != nil {
+		return err
+	}
+
+	if s.writer != nil {
+		// the messages not acknowledged yet are acknowledged once the new
+		// segment is synced, so the old one must be synced now
+		if err := s.writer.Sync(); err != nil {
+			writer.Close()
+			os.Remove(path)
+			return err
+		}
+		s.writer.Close()
+	}
+	s.writer = writer
+	s.segments = append(s.segments, &spoolSegment{seq: seq, path: path})
+
+	return nil
+}
+
+func (s *spool) Drain(message Message) error {
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	record, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+	size := int64(len(record))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.segments[len(s.segments)-1].size >= s.segmentSize {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	for s.totalSize+size > s.maxSize && len(s.segments) > 1 {
+		if s.policy == SpoolPolicyBlock {
+			s.cond.Wait()
+			if s.closed {
+				return ErrClosed
+			}
+			continue
+		}
+		s.dropOldestSegment()
+	}
+
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].size += size
+	s.totalSize += size
+	s.cond.Broadcast()
+	if message.Sent != nil {
+		s.unsynced = append(s.unsynced, message)
+	}
+
+	return nil
+}
+
+// Flush flushes the next Drainer. Messages that were not replayed yet stay in
+// the spool.
+func (s *spool) Flush() error {
+	return Flush(s.next)
+}
+
+// Close stops writing to and replaying from the spool, syncing the segment
+// written to so that the messages written since the last sync can be
+// acknowledged, then closes the next Drainer. Messages that were not
+// replayed yet stay on disk, for a spool using the same dir to pick up from
+// where replay got. So do the messages the next Drainer could not send, which
+// is why they are not returned as unsent.
+func (s *spool) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.writer.Sync()
+	var unsynced []Message
+	if err == nil {
+		unsynced = s.unsynced
+	}
+	s.unsynced = nil
+	err = errors.Join(err, s.writer.Close())
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	sent(unsynced)
+
+	err = errors.Join(err, withoutUnsent(Close(s.next)))
+	return errors.Join(err, s.saveCursor())
+}
+
+// withoutUnsent replaces every UnsentError in err with the error it wraps.
+func withoutUnsent(err error) error {
+	switch e := err.(type) {
+	case *UnsentError:
+		return e.Err
+	case interface{ Unwrap() []error }:
+		var errs []error
+		for _, err := range e.Unwrap() {
+			errs = append(errs, withoutUnsent(err))
+		}
+		return errors.Join(errs...)
+	}
+	return err
+}
+
+// dropOldestSegment must be called with the lock held.
+func (s *spool) dropOldestSegment() {
+	oldest := s.segments[0]
+	s.errorLogger.Printf("Spool is full, dropping %d bytes of unsent messages\n", oldest.size-s.readOffset)
+	droppedMessages.Add(float64(countRecords(oldest.path, s.readOffset)), s.address)
+	s.removeOldestSegment()
+}
+
+// countRecords returns how many messages the segment file at path holds past
+// offset.
+func countRecords(path string, offset int64) int {
+	file, err := os.Open(path) // #nosec G304
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0
+	}
+
+	count := 0
+	reader := bufio.NewReader(file)
+	for {
+		if _, err := reader.ReadSlice('\n'); err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+// addressOf returns the address of the destination drainer sends to, which
+// labels the metrics of the spool in front of it.
+func addressOf(drainer Drainer) string {
+	if destination, ok := drainer.(interface{ address() string }); ok {
+		return destination.address()
+	}
+	return ""
+}
+
+// removeOldestSegment must be called with the lock held.
+func (s *spool) removeOldestSegment() {
+	oldest := s.segments[0]
+	if err := os.Remove(oldest.path); err != nil {
+		s.errorLogger.Printf("Error removing spool segment: %s\n", err)
+	}
+	s.segments = s.segments[1:]
+	s.totalSize -= oldest.size
+	s.readOffset = 0
+	s.cond.Broadcast()
+}
+
+// retireOldestSegment stops replaying the oldest segment, which was read to
+// its end. Its file is kept until its messages were delivered, so that they
+// are replayed again if blackbox stops before. It must be called with the
+// lock held.
+func (s *spool) retireOldestSegment() {
+	oldest := s.segments[0]
+	s.segments = s.segments[1:]
+	s.totalSize -= oldest.size
+	s.readOffset = 0
+	s.replayed = append(s.replayed, oldest)
+	s.removeDelivered()
+	s.cond.Broadcast()
+}
+
+// deliver records that the messages of segment seq up to offset were
+// delivered.
+func (s *spool) deliver(seq int, offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if seq > s.delivered.Seq || (seq == s.delivered.Seq && offset > s.delivered.Offset) {
+		s.delivered = spoolCursor{Seq: seq, Offset: offset}
+		s.removeDelivered()
+	}
+}
+
+// removeDelivered removes the files of the segments whose messages were all
+// delivered. It must be called with the lock held.
+func (s *spool) removeDelivered() {
+	for len(s.replayed) > 0 {
+		oldest := s.replayed[0]
+		if oldest.seq > s.delivered.Seq || (oldest.seq == s.delivered.Seq && s.delivered.Offset < oldest.size) {
+			return
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			s.errorLogger.Printf("Error removing spool segment: %s\n", err)
+		}
+		s.replayed = s.replayed[1:]
+	}
+}
+
+func (s *spool) replay() {
+	var (
+		reader     *bufio.Reader
+		readerFile *os.File
+		readerSeq  = -1
+	)
+
+	for {
+		s.lock.Lock()
+		for {
+			if s.closed {
+				s.lock.Unlock()
+				if readerFile != nil {
+					readerFile.Close()
+				}
+				return
+			}
+			oldest := s.segments[0]
+			if s.readOffset < oldest.size {
+				break
+			}
+			if len(s.segments) == 1 {
+				s.cond.Wait()
+				continue
+			}
+			s.retireOldestSegment()
+		}
+		oldest := s.segments[0]
+		offset := s.readOffset
+		s.lock.Unlock()
+
+		if oldest.seq != readerSeq {
+			if readerFile != nil {
+				readerFile.Close()
+			}
+			var err error
+			readerFile, err = os.Open(oldest.path)
+			if err == nil {
+				_, err = readerFile.Seek(offset, 0)
+			}
+			if err != nil {
+				s.errorLogger.Printf("Error reading spool segment: %s\n", err)
+				readerFile = nil
+				readerSeq = -1
+				time.Sleep(time.Second)
+				continue
+			}
+			reader = bufio.NewReader(readerFile)
+			readerSeq = oldest.seq
+		}
+
+		record, err := reader.ReadBytes('\n')
+		if err != nil {
+			// a segment can end in a partial record if blackbox was killed
+			// while writing it, skip to the next segment
+			s.errorLogger.Printf("Error reading spool segment: %s\n", err)
+			s.lock.Lock()
+			if s.segments[0].seq == readerSeq {
+				s.readOffset = s.segments[0].size
+			}
+			s.lock.Unlock()
+			readerSeq = -1
+			continue
+		}
+
+		var message Message
+		seq, end := readerSeq, offset+int64(len(record))
+		message.Sent = func() { s.deliver(seq, end) }
+		if err := json.Unmarshal(record, &message); err != nil {
+			s.errorLogger.Printf("Skipping corrupt spooled message: %s\n", err)
+		} else if err := s.drain(message); errors.Is(err, ErrClosed) {
+			// leave the message to be replayed by whatever replaces this spool
+			continue
+		} else if err != nil {
+			s.errorLogger.Printf("Error draining spooled message: %s\n", err)
+		}
+
+		s.lock.Lock()
+		if s.segments[0].seq == readerSeq {
+			s.readOffset += int64(len(record))
+		}
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	}
+}
+
+// drain drains message to the next Drainer, backing off while its
+// destination is unavailable. It returns ErrClosed if the spool is closed
+// meanwhile.
+func (s *spool) drain(message Message) error {
+	backoff := time.Second
+	for {
+		err := s.next.Drain(message)
+		if !errors.Is(err, ErrUnavailable) {
+			return err
+		}
+
+		s.errorLogger.Printf("Error draining spooled message: %s. Will retry in %d seconds.\n", err, int(backoff.Seconds()))
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return ErrClosed
+		}
+		backoff = min(backoff*2, maxSpoolBackoff)
+	}
+}
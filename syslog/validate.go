@@ -0,0 +1,159 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var transports = []string{"tcp", "tls", "udp", TransportHTTP, TransportStdout, TransportFile}
+
+// FieldError is a problem with the setting of a field, which is named by its
+// path in the YAML configuration.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// FieldErrors returns the errors joined in err as FieldErrors for fields
+// nested under field.
+func FieldErrors(field string, err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range joined.Unwrap() {
+			errs = append(errs, FieldErrors(field, err)...)
+		}
+		return errs
+	}
+	if fieldErr, ok := err.(*FieldError); ok {
+		return []error{&FieldError{Field: field + "." + fieldErr.Field, Err: fieldErr.Err}}
+	}
+	return []error{&FieldError{Field: field, Err: err}}
+}
+
+// Validate returns every problem with the settings of a destination that can
+// be found without sending to it, joined into one error.
+func (d Drain) Validate() error {
+	var errs []error
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+	}
+
+	switch d.Transport {
+	case "":
+		check("transport", fmt.Errorf("must be one of %s", strings.Join(transports, ", ")))
+	case "tcp", "tls", "udp":
+		if d.Address == "" {
+			check("address", errors.New("must be set"))
+		} else if _, _, err := net.SplitHostPort(d.Address); err != nil {
+			check("address", err)
+		}
+	case TransportHTTP:
+		if d.Address == "" {
+			check("address", errors.New("must be set to a URL"))
+		} else if u, err := url.Parse(d.Address); err != nil {
+			check("address", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			check("address", fmt.Errorf("must be an http or https URL, got %q", d.Address))
+		}
+	case TransportStdout:
+	case TransportFile:
+		if d.File.Path == "" {
+			check("file.path", errors.New("must be set"))
+		}
+	default:
+		check("transport", fmt.Errorf("unknown transport %q, must be one of %s", d.Transport, strings.Join(transports, ", ")))
+	}
+
+	switch d.Framing {
+	case "", FramingOctetCounting, FramingNonTransparent:
+	default:
+		check("framing", fmt.Errorf("unknown framing %q", d.Framing))
+	}
+	switch d.Format {
+	case "", FormatRFC5424, FormatRFC3164:
+	default:
+		check("format", fmt.Errorf("unknown format %q", d.Format))
+	}
+	switch d.OversizePolicy {
+	case "", OversizePolicyTruncate, OversizePolicySplit, OversizePolicyDrop:
+	default:
+		check("oversize_policy", fmt.Errorf("unknown oversize policy %q", d.OversizePolicy))
+	}
+
+	check("ca", checkFile(d.CA))
+	check("cert", checkFile(d.Cert))
+	check("key", checkFile(d.Key))
+	if (d.Cert == "") != (d.Key == "") {
+		check("cert", errors.New("both cert and key must be set for a client certificate"))
+	}
+
+	if d.MaxRetries < 0 {
+		check("max_retries", errors.New("must not be negative"))
+	}
+	if d.Connections < 0 {
+		check("connections", errors.New("must not be negative"))
+	}
+	if d.BatchSize < 0 {
+		check("batch_size", errors.New("must not be negative"))
+	}
+	if d.FlushInterval < 0 {
+		check("flush_interval", errors.New("must not be negative"))
+	}
+	if d.File.MaxSize < 0 {
+		check("file.max_size", errors.New("must not be negative"))
+	}
+	if d.File.MaxBackups < 0 {
+		check("file.max_backups", errors.New("must not be negative"))
+	}
+
+	switch d.HTTP.Body {
+	case "", HTTPBodyNDJSON, HTTPBodyJSONArray:
+	default:
+		check("http.body", fmt.Errorf("unknown http body %q", d.HTTP.Body))
+	}
+	check("http.bearer_token_file", checkFile(d.HTTP.BearerTokenFile))
+
+	if d.Spool.MaxSize < 0 {
+		check("spool.max_size", errors.New("must not be negative"))
+	}
+	switch d.Spool.Policy {
+	case "", SpoolPolicyDropOldest, SpoolPolicyBlock:
+	default:
+		check("spool.policy", fmt.Errorf("unknown spool policy %q", d.Spool.Policy))
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkFile makes sure a file that is read later on exists, so that a typo
+// in its path is reported upfront.
+func checkFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
@@ -5,58 +5,389 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"code.cloudfoundry.org/go-loggregator/v10/rfc5424"
 	"github.com/nxadm/tail"
-	"github.com/nxadm/tail/watch"
 
 	"code.cloudfoundry.org/blackbox/syslog"
 )
 
+// EVICTION_CHECK_INTERVAL is how often a tailer checks whether its file has
+// been idle for too long.
+const EVICTION_CHECK_INTERVAL = 5 * time.Second
+
+// maxLinesPerRead is how many lines a tailer reads before it checks whether
+// it was signalled.
+const maxLinesPerRead = 1024
+
 type Tailer struct {
-	Path    string
-	Tag     string
-	Drainer syslog.Drainer
-	Logger  *log.Logger
+	Path        string
+	Tag         string
+	Priority    rfc5424.Priority
+	Priorities  *PriorityResolver
+	Multiline   *MultilineRule
+	Drainer     syslog.Drainer
+	Logger      *log.Logger
+	Checkpoints *CheckpointStore
+	// Notified tells whether the tailer is woken up when the file is written
+	// to, so that it does not need to read it every FILE_POLL_INTERVAL.
+	Notified func() bool
+	// IdleTimeout stops the tailer once no line was read for that long, if
+	// set.
+	IdleTimeout time.Duration
+	// Location is where to start reading the file, if set, rather than from
+	// its checkpoint or its end.
+	Location *tail.SeekInfo
+	// FromStart makes the tailer read a file without a checkpoint from its
+	// beginning rather than its end.
+	FromStart bool
+
+	// lock guards the fields Update changes while the tailer runs.
+	lock    sync.Mutex
+	inode   uint64
+	head    []byte
+	evicted *eviction
+
+	wakeup chan struct{}
+}
+
+// An eviction records why a tailer stopped on its own, so that its file can
+// be tailed again from where it left off.
+type eviction struct {
+	removed bool
+	at      time.Time
+	inode   uint64
+	offset  int64
+}
+
+// resumeAt returns where to tail the file at path again from, if it was
+// recreated or has grown since the tailer stopped.
+func (e *eviction) resumeAt(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	inode, err := fileID(path)
+	if err != nil {
+		return 0, false
+	}
+
+	switch {
+	case e.removed || inode != e.inode || info.Size() < e.offset:
+		return 0, true
+	case info.Size() == e.offset:
+		return 0, false
+	default:
+		return e.offset, true
+	}
+}
+
+// Update changes how lines are tagged, prioritized and grouped from the next
+// line on, and how long the file may be idle, without reopening it.
+func (tailer *Tailer) Update(tag string, priority rfc5424.Priority, priorities *PriorityResolver, multiline *MultilineRule, idleTimeout time.Duration) {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	if tag != tailer.Tag {
+		// the series of the previous tag would never change again
+		deleteFileMetrics(tailer.Tag, tailer.Path)
+	}
+	tailer.Tag = tag
+	tailer.Priority = priority
+	tailer.Priorities = priorities
+	tailer.Multiline = multiline
+	tailer.IdleTimeout = idleTimeout
+}
+
+// deleteMetrics removes the series of the file once it is no longer tailed,
+// so that files that come and go do not pile up.
+func (tailer *Tailer) deleteMetrics() {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	deleteFileMetrics(tailer.Tag, tailer.Path)
+}
+
+func (tailer *Tailer) idleTimeout() time.Duration {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	return tailer.IdleTimeout
+}
+
+// eviction returns why the tailer stopped on its own, or nil if it did not.
+func (tailer *Tailer) eviction() *eviction {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	return tailer.evicted
+}
+
+func (tailer *Tailer) evict(evicted *eviction) {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	tailer.evicted = evicted
+}
+
+func (tailer *Tailer) multiline() *MultilineRule {
+	tailer.lock.Lock()
+	defer tailer.lock.Unlock()
+
+	return tailer.Multiline
 }
 
 func (tailer *Tailer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
-	watch.POLL_DURATION = 1 * time.Second
+	location, rotated := tailer.startLocation()
 
-	tailer.Logger.Printf("Starting to tail file: %s", tailer.Path)
-	t, err := tail.TailFile(tailer.Path, tail.Config{
-		Follow: true,
-		ReOpen: true,
-		Poll:   true,
-		Location: &tail.SeekInfo{
-			Offset: 0,
-			Whence: io.SeekEnd,
-		},
-		Logger: tailer.Logger,
-	})
+	tailer.inode, _ = fileID(tailer.Path)
 
+	tailer.Logger.Printf("Starting to tail file: %s", tailer.Path)
+	file, err := openFollower(tailer.Path, location, tailer.Logger)
 	if err != nil {
+		if rotated != nil {
+			rotated.Close()
+		}
 		return err
 	}
-	defer t.Cleanup()
+	defer file.Close()
+	if rotated != nil {
+		file.catchUp(rotated)
+	}
 
 	close(ready)
 
+	run := newTailRun(tailer, file)
+	defer run.flushTimer.Stop()
+	evictionTicker := time.NewTicker(EVICTION_CHECK_INTERVAL)
+	defer evictionTicker.Stop()
+	readTimer := time.NewTimer(0)
+	defer readTimer.Stop()
+
 	for {
 		select {
-		case line, ok := <-t.Lines:
-			if !ok {
-				log.Println("lines flushed; exiting tailer")
+		case <-readTimer.C:
+		case <-tailer.wakeup:
+			readTimer.Stop()
+		case <-run.flushTimeout:
+			run.flushPending()
+			continue
+		case <-evictionTicker.C:
+			if run.evictIfIdle() {
 				return nil
 			}
-
-			lineTextNoCr := strings.TrimRight(line.Text, "\r")
-			err = tailer.Drainer.Drain(lineTextNoCr, tailer.Tag)
-			if err != nil {
-				log.Println(err.Error())
-			}
+			continue
 		case <-signals:
-			return t.Stop()
+			run.flushPending()
+			return nil
+		}
+
+		if run.followRotation() {
+			return nil
+		}
+
+		more, err := run.read()
+		if err != nil {
+			run.flushPending()
+			return err
+		}
+		readTimer.Reset(run.nextRead(more))
+	}
+}
+
+// startLocation returns where to start reading the file: where the tailer
+// was told to, from its beginning once the rotated file returned was caught
+// up on, from its checkpoint, or else from its end or its beginning.
+func (tailer *Tailer) startLocation() (*tail.SeekInfo, *rotatedFile) {
+	if tailer.Location != nil {
+		tailer.Logger.Printf("Resuming file %s from offset %d", tailer.Path, tailer.Location.Offset)
+		return tailer.Location, nil
+	}
+
+	if tailer.Checkpoints != nil {
+		if rotated := tailer.Checkpoints.Rotated(tailer.Path); rotated != nil {
+			// every line of the new file was written after the rotation
+			tailer.Logger.Printf("Catching up on file %s from %s, which it was rotated to", tailer.Path, rotated.Name())
+			return &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, rotated
+		}
+		if offset, found := tailer.Checkpoints.Resume(tailer.Path); found {
+			tailer.Logger.Printf("Resuming file %s from offset %d", tailer.Path, offset)
+			return &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}, nil
 		}
 	}
+
+	if tailer.FromStart {
+		return &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}, nil
+	}
+	return &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, nil
+}
+
+// tailRun is the state of a running tailer: the file it follows and the
+// multiline event it is collecting.
+type tailRun struct {
+	tailer *Tailer
+	file   *follower
+
+	pending      *multilineEvent
+	flushTimer   *time.Timer
+	flushTimeout <-chan time.Time
+	lastRead     time.Time
+}
+
+func newTailRun(tailer *Tailer, file *follower) *tailRun {
+	flushTimer := time.NewTimer(time.Hour)
+	flushTimer.Stop()
+
+	return &tailRun{
+		tailer:     tailer,
+		file:       file,
+		flushTimer: flushTimer,
+		lastRead:   time.Now(),
+	}
+}
+
+func (r *tailRun) flushPending() {
+	if r.pending != nil {
+		r.tailer.drain(r.pending.String(), r.pending.offset)
+		r.pending = nil
+	}
+	r.flushTimer.Stop()
+	r.flushTimeout = nil
+}
+
+func (r *tailRun) handleLine(text string, offset int64) {
+	lineTextNoCr := strings.TrimRight(text, "\r")
+	multiline := r.tailer.multiline()
+	if multiline == nil {
+		r.flushPending()
+		r.tailer.drain(lineTextNoCr, offset)
+		return
+	}
+
+	if r.pending != nil && (multiline.startsEvent(lineTextNoCr) || r.pending.size+1+len(lineTextNoCr) > multiline.maxBytes) {
+		r.flushPending()
+	}
+	if r.pending == nil {
+		r.pending = &multilineEvent{}
+	}
+	r.pending.add(lineTextNoCr, offset)
+
+	if len(r.pending.lines) >= multiline.maxLines {
+		r.flushPending()
+		return
+	}
+	r.flushTimer.Reset(multiline.flushTimeout)
+	r.flushTimeout = r.flushTimer.C
+}
+
+// read handles the lines written since the last read, up to maxLinesPerRead
+// so that signals are not kept waiting by a long backlog, and tells whether
+// there are more.
+func (r *tailRun) read() (bool, error) {
+	r.tailer.head = r.file.fingerprint()
+	for range maxLinesPerRead {
+		text, offset, ok, err := r.file.readLine()
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+		r.lastRead = time.Now()
+		r.handleLine(text, offset)
+	}
+	return true, nil
+}
+
+// nextRead returns how long to wait before reading the file again.
+func (r *tailRun) nextRead(more bool) time.Duration {
+	switch {
+	case more:
+		return 0
+	case r.tailer.Notified != nil && r.tailer.Notified() && !r.file.rotating():
+		return POLL_INTERVAL
+	default:
+		return FILE_POLL_INTERVAL
+	}
+}
+
+// followRotation switches to the new file once the one being read was
+// rotated, and tells whether the tailer stopped as the file was removed.
+func (r *tailRun) followRotation() bool {
+	rotation, err := r.file.check()
+	if err != nil {
+		r.tailer.Logger.Printf("could not check whether %s was rotated: %s", r.tailer.Path, err)
+	}
+
+	switch rotation {
+	case switched, truncated:
+		r.flushPending()
+		r.tailer.inode, _ = fileID(r.tailer.Path)
+	case removed:
+		// the last line of the file may have been left unterminated
+		if _, err := r.read(); err != nil {
+			r.tailer.Logger.Printf("could not read the rest of %s: %s", r.tailer.Path, err)
+		}
+		r.flushPending()
+		r.tailer.Logger.Printf("Stopping to tail removed file: %s", r.tailer.Path)
+		r.tailer.evict(&eviction{removed: true, at: time.Now()})
+		return true
+	}
+	return false
+}
+
+// evictIfIdle stops tailing a file no line was read from for the idle
+// timeout, unless it is being rotated, and tells whether it did.
+func (r *tailRun) evictIfIdle() bool {
+	idleTimeout := r.tailer.idleTimeout()
+	if idleTimeout <= 0 || time.Since(r.lastRead) < idleTimeout || r.file.rotating() {
+		return false
+	}
+
+	r.tailer.Logger.Printf("Stopping to tail idle file: %s", r.tailer.Path)
+	r.flushPending()
+	inode, _ := fileID(r.tailer.Path)
+	r.tailer.evict(&eviction{at: time.Now(), inode: inode, offset: r.file.offset})
+	return true
+}
+
+// wake makes a tailer that is notified of writes read its file right away.
+func (tailer *Tailer) wake() {
+	select {
+	case tailer.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (tailer *Tailer) drain(text string, offset int64) {
+	tailer.lock.Lock()
+	tag := tailer.Tag
+	priority := tailer.Priority
+	if tailer.Priorities != nil {
+		priority = tailer.Priorities.Detect(text, priority)
+	}
+	tailer.lock.Unlock()
+
+	message := syslog.Message{
+		Line:     text,
+		Tag:      tag,
+		Path:     tailer.Path,
+		Priority: priority,
+	}
+	if tailer.Checkpoints != nil {
+		// the line is only checkpointed once it was written, which may be
+		// after Drain returns if the destination batches messages
+		inode, head := tailer.inode, tailer.head
+		message.Sent = func() {
+			tailer.Checkpoints.Record(tailer.Path, inode, offset, head)
+		}
+	}
+
+	linesRead.Inc(tag, tailer.Path)
+	if err := tailer.Drainer.Drain(message); err != nil {
+		drainErrors.Inc(tag, tailer.Path)
+		log.Println(err.Error())
+	}
 }